@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"net/http"
+	"strings"
 
 	"github.com/AlpacaDB/istore/istore"
 	"github.com/golang/glog"
@@ -11,8 +12,55 @@ import (
 func main() {
 	laddr := flag.String("l", ":8592", "listen address")
 	dbfile := flag.String("d", "/tmp/metadb", "datagbase file path")
+	s3endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint URL for s3:// (default $ISTORE_S3_ENDPOINT)")
+	s3region := flag.String("s3-region", "", "S3 region for s3:// (default $AWS_REGION)")
+	blobdir := flag.String("b", "", "blob store directory (default {dbfile}.blobs)")
+	cacheControl := flag.String("cache-control", "", "Cache-Control of processed output per operation, e.g. \"resize=public, max-age=86400;frame=max-age=60\" (empty operation for default)")
+	autoorient := flag.Bool("autoorient", istore.AutoOrient, "apply EXIF orientation before processing images")
+	jobs := flag.Int("jobs", istore.JobWorkers, "number of asynchronous jobs to run concurrently")
+	batchWorkers := flag.Int("batch-workers", istore.BatchWorkers, "number of items of _batch_get to process concurrently")
+	maxPixels := flag.Int("max-pixels", istore.MaxPixels, "maximum pixels of images to decode (0 for no limit)")
+	maxDimension := flag.Int("max-dimension", istore.MaxDimension, "maximum width and height given to resize, fill, pad etc. (0 for no limit)")
+	maxProcessing := flag.Int("max-processing", istore.MaxProcessing, "number of images to process concurrently (0 for no limit)")
+	maxMemory := flag.Int64("max-processing-memory", istore.MaxProcessingMemory>>20, "estimated memory in MB of images processed concurrently (0 for no limit)")
+	renditionCache := flag.Int("rendition-cache", istore.RenditionCacheSize>>20, "size in MB of the cache of processed output (0 to disable)")
+	transcodeCacheDir := flag.String("transcode-cache-dir", istore.TranscodeCacheDir, "directory to cache the output of clip and transcode (empty to disable)")
+	transcodeCache := flag.Int64("transcode-cache", istore.TranscodeCacheSize>>20, "size in MB of the cache of clip and transcode output")
+	processingTimeout := flag.Duration("processing-timeout", istore.ProcessingTimeout, "how long to wait for processing before responding 503")
+	maxQueue := flag.Int("max-processing-queue", istore.MaxProcessingQueue, "number of requests waiting for processing before responding 429 (0 for no limit)")
+	maxGIFFrames := flag.Int("max-gif-frames", istore.MaxGIFFrames, "maximum frames of animated GIF to decode (0 for no limit)")
+	maxExpandFrames := flag.Int("max-expand-frames", istore.MaxExpandFrames, "maximum frames registered by one expand of a video (0 for no limit)")
 	flag.Parse()
+	istore.JobWorkers = *jobs
+	istore.BatchWorkers = *batchWorkers
+	istore.MaxPixels = *maxPixels
+	istore.MaxDimension = *maxDimension
+	istore.MaxProcessing = *maxProcessing
+	istore.MaxProcessingMemory = *maxMemory << 20
+	istore.ProcessingTimeout = *processingTimeout
+	istore.MaxProcessingQueue = *maxQueue
+	istore.MaxGIFFrames = *maxGIFFrames
+	istore.MaxExpandFrames = *maxExpandFrames
+	istore.RenditionCacheSize = *renditionCache << 20
+	istore.TranscodeCacheDir = *transcodeCacheDir
+	istore.TranscodeCacheSize = *transcodeCache << 20
+	istore.AutoOrient = *autoorient
+	for _, opval := range strings.Split(*cacheControl, ";") {
+		if pair := strings.SplitN(opval, "=", 2); len(pair) == 2 {
+			istore.CacheControl[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	}
 	handler := istore.NewServer(*dbfile)
+	if *blobdir != "" {
+		handler.Blobs = istore.NewBlobStore(*blobdir)
+	}
+	if *s3endpoint != "" {
+		handler.S3.Endpoint = *s3endpoint
+		handler.S3.PathStyle = true
+	}
+	if *s3region != "" {
+		handler.S3.Region = *s3region
+	}
 	glog.Infof("Listening on %v using DB at %v", *laddr, *dbfile)
 	err := http.ListenAndServe(*laddr, handler)
 	if err != nil {
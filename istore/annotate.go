@@ -0,0 +1,168 @@
+package istore
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// annotationColors are assigned to labels without a color given.
+var annotationColors = []string{
+	"#e6194b", "#3cb44b", "#ffe119", "#4363d8", "#f58231", "#911eb4",
+	"#46f0f0", "#f032e6", "#bcf60c", "#fabebe", "#008080", "#9a6324",
+}
+
+type annotateOptions struct {
+	// Field is the metadata field of the annotations, "boxes" by default.
+	Field string
+	// Threshold drops the annotations of lower score.
+	Threshold float64
+	// Colors are the colors of each label, e.g. "person:#f00,car:#00f".
+	Colors map[string]string
+	// Width is the line width unless the annotation has it.
+	Width float64
+}
+
+func parseAnnotateOptions(r *http.Request) (*annotateOptions, error) {
+	opts := &annotateOptions{Field: r.FormValue("field"), Colors: map[string]string{}}
+	if opts.Field == "" {
+		opts.Field = "boxes"
+	}
+	if v := r.FormValue("threshold"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, badRequest("invalid threshold %q", v)
+		}
+		opts.Threshold = threshold
+	}
+	if v := r.FormValue("width"); v != "" {
+		width, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, badRequest("invalid width %q", v)
+		}
+		opts.Width = width
+	}
+	if v := r.FormValue("colors"); v != "" {
+		for _, kv := range strings.Split(v, ",") {
+			pair := strings.SplitN(kv, ":", 2)
+			if len(pair) != 2 {
+				return nil, badRequest("invalid colors %q", v)
+			}
+			if _, err := parseColor(pair[1]); err != nil {
+				return nil, badRequest("invalid colors %q", v)
+			}
+			opts.Colors[pair[0]] = pair[1]
+		}
+	}
+	return opts, nil
+}
+
+func metaFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// labelColor picks the color of the label, stable across requests.
+func labelColor(label string, colors map[string]string) string {
+	if col, ok := colors[label]; ok {
+		return col
+	}
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	return annotationColors[h.Sum32()%uint32(len(annotationColors))]
+}
+
+// annotationOverlay converts the annotations in the metadata to the overlay.
+// Each annotation is a box of {x1, y1, x2, y2, label, score} unless it has
+// "type" of the overlay shape.
+func annotationOverlay(metadata map[string]interface{}, opts *annotateOptions) (string, error) {
+	value, ok := metadata[opts.Field]
+	if !ok {
+		// nothing to draw
+		return "[]", nil
+	}
+	annotations, ok := value.([]interface{})
+	if !ok {
+		return "", fmt.Errorf("metadata %s is not a list", opts.Field)
+	}
+
+	shapes := []map[string]interface{}{}
+	for _, a := range annotations {
+		annotation, ok := a.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("annotation %v in %s is not an object", a, opts.Field)
+		}
+		shape := map[string]interface{}{}
+		for k, v := range annotation {
+			shape[k] = v
+		}
+
+		score, hasScore := metaFloat(shape["score"])
+		if hasScore && score < opts.Threshold {
+			continue
+		}
+		if _, ok := shape["type"]; !ok {
+			shape["type"] = "box"
+		}
+		if _, ok := shape["width"]; !ok && opts.Width > 0 {
+			shape["width"] = opts.Width
+		}
+
+		label := ""
+		if v, ok := shape["label"]; ok {
+			// class ids may be numbers
+			label = fmt.Sprint(v)
+			shape["label"] = label
+		}
+		if _, ok := shape["color"]; !ok {
+			shape["color"] = labelColor(label, opts.Colors)
+		}
+		if hasScore {
+			shape["label"] = strings.TrimSpace(fmt.Sprintf("%s %.2f", label, score))
+		}
+		shapes = append(shapes, shape)
+	}
+
+	data, err := json.Marshal(shapes)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// setAnnotationOverlay puts the overlay from the metadata of the item to the
+// query, so that Etag changes with the annotations.
+func (s *Server) setAnnotationOverlay(r *http.Request) error {
+	data, err := s.Db.Get([]byte(r.URL.Path), nil)
+	if err != nil {
+		return err
+	}
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(data); err != nil {
+		return err
+	}
+	opts, err := parseAnnotateOptions(r)
+	if err != nil {
+		return err
+	}
+	overlay, err := annotationOverlay(meta.MetaData, opts)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	query.Set("overlay", overlay)
+	r.URL.RawQuery = query.Encode()
+	r.Form = nil
+	return nil
+}
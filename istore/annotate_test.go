@@ -0,0 +1,69 @@
+package istore
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestAnnotationOverlay(c *C) {
+	metadata := map[string]interface{}{
+		"boxes": []interface{}{
+			map[string]interface{}{"x1": 1.0, "y1": 2.0, "x2": 3.0, "y2": 4.0, "label": "cat", "score": 0.9},
+			map[string]interface{}{"x1": 1.0, "y1": 2.0, "x2": 3.0, "y2": 4.0, "label": "dog", "score": 0.1},
+			map[string]interface{}{"type": "circle", "x": 5.0, "y": 5.0, "r": 2.0, "label": int64(3)},
+		},
+	}
+	opts := &annotateOptions{Field: "boxes", Threshold: 0.5, Colors: map[string]string{"cat": "#00f"}}
+	overlay, err := annotationOverlay(metadata, opts)
+	c.Assert(err, IsNil)
+	shapes := []map[string]interface{}{}
+	c.Assert(json.Unmarshal([]byte(overlay), &shapes), IsNil)
+	c.Assert(len(shapes), Equals, 2)
+	c.Check(shapes[0]["type"], Equals, "box")
+	c.Check(shapes[0]["color"], Equals, "#00f")
+	c.Check(shapes[0]["label"], Equals, "cat 0.90")
+	c.Check(shapes[1]["label"], Equals, "3")
+	c.Check(shapes[1]["color"], Equals, labelColor("3", nil))
+
+	overlay, err = annotationOverlay(metadata, &annotateOptions{Field: "faces"})
+	c.Assert(err, IsNil)
+	c.Check(overlay, Equals, "[]")
+	_, err = annotationOverlay(map[string]interface{}{"boxes": 1.0}, opts)
+	c.Check(err, NotNil)
+}
+
+func (_ *S) TestAnnotate(c *C) {
+	server := newTestServer()
+	imgfile := filepath.Join(server.Dir, "white.png")
+	m := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	f, _ := os.Create(imgfile)
+	png.Encode(f, m)
+	f.Close()
+
+	metadata := url.QueryEscape(`{"boxes": [
+		{"x1": 5, "y1": 5, "x2": 25, "y2": 25, "label": "cat", "score": 0.9},
+		{"x1": 30, "y1": 30, "x2": 38, "y2": 38, "label": "dog", "score": 0.3}]}`)
+	server.request("POST", "/path/annotate/file://"+imgfile+"?metadata="+metadata, "")
+
+	mock := server.request("GET", "/path/annotate/file://"+imgfile+"?apply=annotate&threshold=0.5&colors=cat:%2300f", "")
+	c.Assert(mock.status, Equals, http.StatusOK)
+	out, err := png.Decode(&mock.body)
+	c.Assert(err, IsNil)
+	c.Check(out.At(5, 15), Equals, color.RGBA{0, 0, 255, 255})
+	c.Check(out.At(30, 34), Equals, color.RGBA{255, 255, 255, 255})
+
+	for _, query := range []string{"threshold=high", "width=thick", "colors=cat", "colors=cat:red"} {
+		mock := server.request("GET", "/path/annotate/file://"+imgfile+"?apply=annotate&"+query, "")
+		c.Check(mock.status, Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
@@ -0,0 +1,203 @@
+package istore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// archiveExtensions are the file extensions of the common content types,
+// as mime.ExtensionsByType may give e.g. ".jpe" for JPEG.
+var archiveExtensions = map[string]string{
+	"image/jpeg":        ".jpg",
+	"image/png":         ".png",
+	"image/gif":         ".gif",
+	"video/mp4":         ".mp4",
+	"application/x-npy": ".npy",
+}
+
+// ArchiveEntry is the item in the manifest of the archive, with the file
+// name in the archive or the error while fetching it.
+type ArchiveEntry struct {
+	ItemMeta
+	File  string `json:"_file,omitempty"`
+	Error string `json:"_error,omitempty"`
+}
+
+// archiveWriter writes files to tar or zip.
+type archiveWriter interface {
+	WriteFile(name string, data []byte, modTime time.Time) error
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a tarArchive) WriteFile(name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := a.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.Write(data)
+	return err
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) WriteFile(name string, data []byte, modTime time.Time) error {
+	header := &zip.FileHeader{
+		Name: name,
+		// images are compressed already
+		Method: zip.Store,
+	}
+	header.SetModTime(modTime)
+	f, err := a.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// archiveExtension returns the file extension of the content, or of the
+// target URL.
+func archiveExtension(contentType, Url string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if ext, ok := archiveExtensions[mediaType]; ok {
+			return ext
+		}
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			return exts[0]
+		}
+	}
+	if u, err := url.Parse(Url); err == nil {
+		return path.Ext(u.Path)
+	}
+	return ""
+}
+
+// ServeArchive streams the items under the directory in tar or zip, each
+// processed by the apply parameters if given.  manifest.json at the end
+// has the metadata of the items.
+func (s *Server) ServeArchive(w http.ResponseWriter, r *http.Request, dir string) {
+	format := r.FormValue("archive")
+	if format != "tar" && format != "zip" {
+		http.Error(w, fmt.Sprintf("unknown archive %q", format), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	query.Del("archive")
+	rawQuery := query.Encode()
+
+	// The items are listed first not to hold the iterator while fetching.
+	entries := []ArchiveEntry{}
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		if extractTargetURL(key) == "" {
+			continue
+		}
+		entry := ArchiveEntry{}
+		if _, err := entry.UnmarshalMsg(iter.Value()); err != nil {
+			glog.Error("failed to unmarshal metadata from db ", err)
+		}
+		entry.FilePath = key
+		entries = append(entries, entry)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	name := path.Base(dir)
+	if name == "/" || name == "." {
+		name = "istore"
+	}
+	var archive archiveWriter
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+		archive = tarArchive{tar.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = zipArchive{zip.NewWriter(w)}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+
+	type archiveItem struct {
+		entry   ArchiveEntry
+		data    []byte
+		modTime time.Time
+	}
+	process := func(i int) interface{} {
+		item := &archiveItem{entry: entries[i]}
+		key := item.entry.FilePath
+		data, resp, err := s.fetchItem(key, rawQuery)
+		if err != nil {
+			// the others are still archived
+			glog.Error(err)
+			item.entry.Error = strings.TrimSpace(err.Error())
+			return item
+		}
+		item.data = data
+		if item.modTime, err = http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+			item.modTime = time.Now()
+		}
+		base := fmt.Sprintf("%d", item.entry.ItemId)
+		if item.entry.ItemId == 0 {
+			// unknown without the metadata, and unique by the index
+			base = fmt.Sprintf("item%d", i)
+		}
+		item.entry.File = base + archiveExtension(resp.Header.Get("Content-Type"), extractTargetURL(key))
+		return item
+	}
+
+	manifest := []ArchiveEntry{}
+	err := processInOrder(len(entries), BatchWorkers, process, func(v interface{}) error {
+		item := v.(*archiveItem)
+		if item.entry.File != "" {
+			if err := archive.WriteFile(item.entry.File, item.data, item.modTime); err != nil {
+				return err
+			}
+		}
+		manifest = append(manifest, item.entry)
+		return nil
+	})
+	if err != nil {
+		// the client has gone
+		glog.Error(err)
+		return
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if err := archive.WriteFile("manifest.json", data, time.Now()); err != nil {
+		glog.Error(err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		glog.Error(err)
+	}
+}
@@ -0,0 +1,85 @@
+package istore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestServeArchive(c *C) {
+	server := newTestServer()
+	testdata := testdataFile("sample.jpg")
+	for _, key := range []string{
+		"/path/archive/file://" + testdata,
+		"/path/archive/sub/file://" + testdata,
+		"/path/archive/file://" + filepath.Join(server.Dir, "missing.jpg"),
+	} {
+		server.request("POST", key, "")
+	}
+
+	mock := server.request("GET", "/path/archive/?archive=tar&apply=resize&w=50", "")
+	c.Check(mock.header.Get("Content-Type"), Equals, "application/x-tar")
+	c.Check(mock.header.Get("Content-Disposition"), Equals, `attachment; filename="archive.tar"`)
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(&mock.body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		files[header.Name], _ = ioutil.ReadAll(tr)
+	}
+	c.Assert(len(files), Equals, 3)
+
+	manifest := []ArchiveEntry{}
+	c.Assert(json.Unmarshal(files["manifest.json"], &manifest), IsNil)
+	c.Assert(len(manifest), Equals, 3)
+	errors := 0
+	for _, entry := range manifest {
+		if entry.Error != "" {
+			errors++
+			c.Check(entry.File, Equals, "")
+			continue
+		}
+		c.Check(filepath.Ext(entry.File), Equals, ".jpg")
+		m, _, err := image.Decode(bytes.NewReader(files[entry.File]))
+		c.Assert(err, IsNil)
+		c.Check(m.Bounds().Dx(), Equals, 50)
+	}
+	c.Check(errors, Equals, 1)
+
+	mock = server.request("GET", "/path/archive/sub/?archive=zip", "")
+	c.Check(mock.header.Get("Content-Type"), Equals, "application/zip")
+	zr, err := zip.NewReader(bytes.NewReader(mock.body.Bytes()), int64(mock.body.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(len(zr.File), Equals, 2)
+	c.Check(zr.File[1].Name, Equals, "manifest.json")
+	f, _ := zr.File[0].Open()
+	data, _ := ioutil.ReadAll(f)
+	original, _ := ioutil.ReadFile(testdata)
+	c.Check(data, DeepEquals, original)
+
+	// unique names without the item ids
+	for _, key := range []string{"/path/broken/file://" + testdata, "/path/broken/sub/file://" + testdata} {
+		c.Assert(server.Db.Put([]byte(key), []byte("broken"), nil), IsNil)
+	}
+	mock = server.request("GET", "/path/broken/?archive=zip", "")
+	zr, err = zip.NewReader(bytes.NewReader(mock.body.Bytes()), int64(mock.body.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(len(zr.File), Equals, 3)
+	c.Check(zr.File[0].Name, Equals, "item0.jpg")
+	c.Check(zr.File[1].Name, Equals, "item1.jpg")
+
+	mock = server.request("GET", "/path/archive/?archive=rar", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+}
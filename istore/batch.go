@@ -0,0 +1,286 @@
+package istore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// BatchWorkers is the number of items of _batch_get processed concurrently.
+var BatchWorkers = 8
+
+// MaxBatchItems limits the number of items in a _batch_get request.
+var MaxBatchItems = 1000
+
+type BatchGetItem struct {
+	// Path is the item key, or relative to the directory of _batch_get.
+	Path string `json:"path"`
+	// Query is the parameters of the item, e.g. "apply=crop&x1=10", which
+	// override the shared ones.
+	Query string `json:"query,omitempty"`
+}
+
+type BatchGetArgs struct {
+	Items []BatchGetItem `json:"items,omitempty"`
+	// Paths are the items without their own parameters.
+	Paths []string `json:"paths,omitempty"`
+	// Query is the parameters shared by the items, e.g. "apply=resize&w=224".
+	Query string `json:"query,omitempty"`
+	// Format is "multipart" (default) or "ndjson".
+	Format string `json:"format,omitempty"`
+	// Concurrency lowers the number of workers, up to BatchWorkers.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+type BatchGetResult struct {
+	Index  int         `json:"index"`
+	Path   string      `json:"path"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// Data is base64 encoded in ndjson.
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// batchRequest makes the GET request of the item for GetApply.
+func batchRequest(dir string, item BatchGetItem, shared url.Values) (*http.Request, error) {
+	query := url.Values{}
+	for key, values := range shared {
+		query[key] = values
+	}
+	if item.Query != "" {
+		values, err := url.ParseQuery(item.Query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query %q", item.Query)
+		}
+		for key, v := range values {
+			query[key] = v
+		}
+	}
+
+	path := item.Path
+	if !strings.HasPrefix(path, "/") {
+		path = dir + path
+	}
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, fmt.Errorf("invalid path %q", item.Path)
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.URL = &url.URL{Path: path, RawQuery: query.Encode()}
+	return r, nil
+}
+
+// batchGetItem processes the item like ServeGet.
+func (s *Server) batchGetItem(dir string, index int, item BatchGetItem, shared url.Values) *BatchGetResult {
+	result := &BatchGetResult{Index: index, Path: item.Path}
+	r, err := batchRequest(dir, item, shared)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result
+	}
+	result.Path = r.URL.Path
+
+	if _, err := s.Db.Get([]byte(r.URL.Path), nil); err != nil {
+		result.Status = http.StatusInternalServerError
+		if err == leveldb.ErrNotFound {
+			result.Status = http.StatusNotFound
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	resp, err := s.GetApply(r)
+	if err != nil {
+		glog.Error(err)
+		result.Status = errorStatus(err, resp)
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	result.Header = http.Header{}
+	for key, values := range resp.Header {
+		if key == "Content-Type" || key == "Etag" || strings.HasPrefix(key, "X-Istore-") {
+			result.Header[key] = values
+		}
+	}
+	if result.Data, err = ioutil.ReadAll(resp.Body); err != nil {
+		result.Status = http.StatusInternalServerError
+		result.Error = err.Error()
+		result.Data = nil
+	}
+	return result
+}
+
+// BatchGet serves many items at once, e.g. a batch of a data loader.  The
+// items are processed concurrently and streamed in the requested order,
+// with the errors of each.
+func (s *Server) BatchGet(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	dir = dir[0 : len(dir)-len("_batch_get")]
+	if !strings.HasSuffix(dir, "/") {
+		http.Error(w, "batch_get should finish with '/'", http.StatusBadRequest)
+		return
+	}
+
+	args := BatchGetArgs{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(body, &args) != nil {
+		http.Error(w, "unrecognized args", http.StatusBadRequest)
+		return
+	}
+	items := args.Items
+	for _, path := range args.Paths {
+		items = append(items, BatchGetItem{Path: path})
+	}
+	if len(items) == 0 || len(items) > MaxBatchItems {
+		http.Error(w, fmt.Sprintf("number of items should be 1 - %d", MaxBatchItems), http.StatusBadRequest)
+		return
+	}
+	shared, err := url.ParseQuery(args.Query)
+	if err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	if args.Format == "" {
+		args.Format = "multipart"
+	}
+	if args.Format != "multipart" && args.Format != "ndjson" {
+		http.Error(w, fmt.Sprintf("unknown format %q", args.Format), http.StatusBadRequest)
+		return
+	}
+
+	workers := BatchWorkers
+	if args.Concurrency > 0 && args.Concurrency < workers {
+		workers = args.Concurrency
+	}
+
+	var mw *multipart.Writer
+	if args.Format == "multipart" {
+		mw = multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	process := func(i int) interface{} {
+		return s.batchGetItem(dir, i, items[i], shared)
+	}
+	err = processInOrder(len(items), workers, process, func(v interface{}) error {
+		result := v.(*BatchGetResult)
+		var err error
+		if mw == nil {
+			err = encoder.Encode(result)
+		} else {
+			err = writeBatchPart(mw, result)
+		}
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if mw != nil {
+		if err := mw.Close(); err != nil {
+			glog.Error(err)
+		}
+	}
+}
+
+// processInOrder processes n items by up to workers goroutines, and writes
+// the results in the order of the items.  Up to workers items are processed
+// or wait to be written, so a slow item doesn't make the others pile up in
+// the memory.  It stops at the first error of write.
+func processInOrder(n, workers int, process func(i int) interface{}, write func(result interface{}) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Each item has its own channel to be written in order.
+	results := make([]chan interface{}, n)
+	for i := range results {
+		results[i] = make(chan interface{}, 1)
+	}
+	// The writer releases the slot of each item.
+	slots := make(chan struct{}, workers)
+	queue := make(chan int)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(queue)
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case queue <- i:
+			case <-done:
+				// the client has gone
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range queue {
+				results[i] <- process(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		result := <-results[i]
+		<-slots
+		if err := write(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatchPart writes the result as a part with X-Istore-Path,
+// X-Istore-Status and X-Istore-Error.  The part of an error has no body.
+func writeBatchPart(mw *multipart.Writer, result *BatchGetResult) error {
+	header := textproto.MIMEHeader{}
+	for key, values := range result.Header {
+		header[key] = values
+	}
+	header.Set("X-Istore-Index", strconv.Itoa(result.Index))
+	header.Set("X-Istore-Path", result.Path)
+	header.Set("X-Istore-Status", strconv.Itoa(result.Status))
+	if result.Error != "" {
+		// errors may span lines
+		header.Set("X-Istore-Error", strings.Replace(result.Error, "\n", " ", -1))
+	}
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(result.Data)
+	return err
+}
@@ -0,0 +1,73 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestBatchGet(c *C) {
+	server := newTestServer()
+	testdata := testdataFile("sample.jpg")
+	server.request("POST", "/path/batch/file://"+testdata, "")
+
+	batchGet := func(args string) *mockWriter {
+		return server.request("POST", "/path/batch/_batch_get", args)
+	}
+
+	mock := batchGet(`{
+		"query": "apply=resize&w=100",
+		"items": [
+			{"path": "file://` + testdata + `"},
+			{"path": "/path/batch/file://` + testdata + `", "query": "w=50"},
+			{"path": "missing.jpg"}
+		],
+		"format": "ndjson"
+	}`)
+	c.Check(mock.status, Equals, http.StatusOK)
+	c.Check(mock.header.Get("Content-Type"), Equals, "application/x-ndjson")
+	decoder := json.NewDecoder(&mock.body)
+	results := []BatchGetResult{}
+	for decoder.More() {
+		result := BatchGetResult{}
+		c.Assert(decoder.Decode(&result), IsNil)
+		results = append(results, result)
+	}
+	c.Assert(len(results), Equals, 3)
+	for i, width := range []int{100, 50} {
+		c.Check(results[i].Index, Equals, i)
+		c.Check(results[i].Path, Equals, "/path/batch/file://"+testdata)
+		c.Check(results[i].Status, Equals, http.StatusOK)
+		c.Check(results[i].Header.Get("Content-Type"), Equals, "image/jpeg")
+		m, _, err := image.Decode(bytes.NewReader(results[i].Data))
+		c.Assert(err, IsNil)
+		c.Check(m.Bounds().Dx(), Equals, width)
+	}
+	c.Check(results[2].Status, Equals, http.StatusNotFound)
+	c.Check(results[2].Error, Not(Equals), "")
+
+	mock = batchGet(`{"paths": ["missing.jpg", "file://` + testdata + `"]}`)
+	mediaType, params, err := mime.ParseMediaType(mock.header.Get("Content-Type"))
+	c.Assert(err, IsNil)
+	c.Check(mediaType, Equals, "multipart/mixed")
+	mr := multipart.NewReader(&mock.body, params["boundary"])
+	part, err := mr.NextPart()
+	c.Assert(err, IsNil)
+	c.Check(part.Header.Get("X-Istore-Status"), Equals, "404")
+	part, err = mr.NextPart()
+	c.Assert(err, IsNil)
+	c.Check(part.Header.Get("X-Istore-Index"), Equals, "1")
+	c.Check(part.Header.Get("X-Istore-Status"), Equals, "200")
+	data, _ := ioutil.ReadAll(part)
+	original, _ := ioutil.ReadFile(testdata)
+	c.Check(data, DeepEquals, original)
+
+	mock = batchGet(`{"paths": []}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+}
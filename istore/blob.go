@@ -0,0 +1,208 @@
+package istore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// BlobStore is a local content-addressed store for uploaded objects.
+// Each blob is stored under its SHA-256 hex digest, so identical content
+// is stored only once no matter how many items refer to it.
+type BlobStore struct {
+	Dir string
+}
+
+var blobDigestRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func NewBlobStore(dir string) *BlobStore {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		glog.Error(err)
+	}
+	return &BlobStore{Dir: dir}
+}
+
+// Path returns the local file path of the blob.
+func (b *BlobStore) Path(digest string) string {
+	return filepath.Join(b.Dir, digest[0:2], digest)
+}
+
+// Put stores the content read from input and returns its hex digest and size.
+func (b *BlobStore) Put(input io.Reader) (digest string, size int64, err error) {
+	tmp, err := ioutil.TempFile(b.Dir, ".upload")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, hash), input)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	digest = hex.EncodeToString(hash.Sum(nil))
+	dest := b.Path(digest)
+	if _, err := os.Stat(dest); err == nil {
+		// we already have the same content
+		return digest, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", 0, err
+	}
+
+	return digest, size, nil
+}
+
+// blobURL returns blob://digest/name, where name is kept only to tell
+// the file type and to make the key readable.
+func blobURL(digest, name string) string {
+	if name == "" {
+		return "blob://" + digest
+	}
+	return "blob://" + digest + "/" + path.Base("/"+name)
+}
+
+func (s *Server) blobGet(req *http.Request) (*http.Response, error) {
+	digest := req.URL.Host
+	if !blobDigestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf("invalid blob digest %q", digest)
+	}
+	resp, err := serveFile(req, s.Blobs.Path(digest), req.URL.Path)
+	if err == nil {
+		// the content never changes for the digest
+		resp.Header.Set("Etag", `"`+digest+`"`)
+	}
+	return resp, err
+}
+
+// Upload stores the request body content to the blob store and registers
+// items under the directory.  It accepts either multipart/form-data with
+// "file" parts (and optional "metadata"), or the raw body with "name" and
+// "metadata" in the query string.
+func (s *Server) Upload(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	dir = dir[0 : len(dir)-len("_upload")]
+	if !strings.HasSuffix(dir, "/") {
+		http.Error(w, "upload should finish with '/'", http.StatusBadRequest)
+		return
+	}
+
+	type upload struct {
+		name   string
+		digest string
+		size   int64
+		ctype  string
+	}
+	uploads := []upload{}
+	var value string
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		value = r.FormValue("metadata")
+		for _, fh := range r.MultipartForm.File["file"] {
+			file, err := fh.Open()
+			if err != nil {
+				glog.Error(err)
+				http.Error(w, "Error", http.StatusInternalServerError)
+				return
+			}
+			digest, size, err := s.Blobs.Put(file)
+			file.Close()
+			if err != nil {
+				glog.Error(err)
+				http.Error(w, "Error", http.StatusInternalServerError)
+				return
+			}
+			uploads = append(uploads, upload{fh.Filename, digest, size, fh.Header.Get("Content-Type")})
+		}
+	} else {
+		query := r.URL.Query()
+		value = query.Get("metadata")
+		digest, size, err := s.Blobs.Put(r.Body)
+		if err != nil {
+			glog.Error(err)
+			http.Error(w, "Error", http.StatusInternalServerError)
+			return
+		}
+		uploads = append(uploads, upload{query.Get("name"), digest, size, r.Header.Get("Content-Type")})
+	}
+
+	if len(uploads) == 0 {
+		http.Error(w, "no file to upload", http.StatusBadRequest)
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	overwrite := r.Method == "POST"
+	results := []interface{}{}
+	// the same file given twice is the same item, which is put only once
+	// as the batch isn't visible to PutObject yet
+	uploaded := map[string]interface{}{}
+	for _, u := range uploads {
+		key := dir + blobURL(u.digest, u.name)
+		if meta, ok := uploaded[key]; ok {
+			results = append(results, meta)
+			continue
+		}
+		metabytes, _, err := s.PutObject([]byte(key), value, batch, overwrite)
+		if err != nil {
+			glog.Error(err)
+			http.Error(w, "Error", http.StatusBadRequest)
+			return
+		}
+		if u.ctype == "" || u.ctype == "application/x-www-form-urlencoded" {
+			u.ctype = mime.TypeByExtension(filepath.Ext(u.name))
+		}
+		if metabytes, err = withContentInfo(metabytes, u.digest, u.size, u.ctype); err != nil {
+			glog.Error(err)
+			http.Error(w, "Error", http.StatusInternalServerError)
+			return
+		}
+		batch.Put([]byte(key), metabytes)
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(metabytes); err != nil {
+			glog.Error(err)
+		}
+		meta.FilePath = key
+		uploaded[key] = meta
+		results = append(results, meta)
+	}
+
+	if err := s.Db.Write(batch, nil); err != nil {
+		msg := fmt.Sprintf("upload failed for %s: %v", dir, err)
+		glog.Error(msg)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header()["Content-type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(results); err != nil {
+		glog.Error(err)
+	}
+}
@@ -0,0 +1,78 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestUpload(c *C) {
+	server := newTestServer()
+
+	content, _ := ioutil.ReadFile(filepath.Join("testdata", "sample.jpg"))
+
+	// raw body
+	r, _ := http.NewRequest("POST", "http://example.com/path/up/_upload?name=sample.jpg", bytes.NewReader(content))
+	mock := server.do(r)
+	c.Check(mock.status, Equals, http.StatusCreated)
+	items := []ItemMeta{}
+	c.Check(json.Unmarshal(mock.body.Bytes(), &items), Equals, nil)
+	c.Assert(len(items), Equals, 1)
+	c.Check(strings.HasPrefix(items[0].FilePath, "/path/up/blob://"), Equals, true)
+	c.Check(strings.HasSuffix(items[0].FilePath, "/sample.jpg"), Equals, true)
+
+	// multipart with the same content goes to the same blob
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("metadata", `{"name": "Bob"}`)
+	part, _ := writer.CreateFormFile("file", "sample.jpg")
+	part.Write(content)
+	writer.Close()
+	r, _ = http.NewRequest("POST", "http://example.com/path/up/_upload", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	mock = server.do(r)
+	c.Check(mock.status, Equals, http.StatusCreated)
+	items2 := []ItemMeta{}
+	json.Unmarshal(mock.body.Bytes(), &items2)
+	c.Assert(len(items2), Equals, 1)
+	c.Check(items2[0].FilePath, Equals, items[0].FilePath)
+	c.Check(items2[0].MetaData["name"], Equals, "Bob")
+
+	// the same file twice in a request is one item
+	body = new(bytes.Buffer)
+	writer = multipart.NewWriter(body)
+	for i := 0; i < 2; i++ {
+		part, _ := writer.CreateFormFile("file", "twice.jpg")
+		part.Write(content)
+	}
+	writer.Close()
+	r, _ = http.NewRequest("POST", "http://example.com/path/up/_upload", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	mock = server.do(r)
+	c.Check(mock.status, Equals, http.StatusCreated)
+	items3 := []ItemMeta{}
+	json.Unmarshal(mock.body.Bytes(), &items3)
+	c.Assert(len(items3), Equals, 2)
+	c.Check(items3[1].FilePath, Equals, items3[0].FilePath)
+	c.Check(items3[1].ItemId, Equals, items3[0].ItemId)
+	data, err := server.Db.Get([]byte(items3[0].FilePath), nil)
+	c.Assert(err, IsNil)
+	stored := ItemMeta{}
+	stored.UnmarshalMsg(data)
+	c.Check(stored.ItemId, Equals, items3[0].ItemId)
+
+	// GET goes through the apply pipeline
+	mock = server.request("GET", items[0].FilePath+"?apply=resize&w=100", "")
+	c.Check(mock.status, Equals, http.StatusOK)
+	img, format, err := image.Decode(bytes.NewReader(mock.body.Bytes()))
+	c.Check(err, Equals, nil)
+	c.Check(format, Equals, "jpeg")
+	c.Check(img.Bounds().Dx(), Equals, 100)
+}
@@ -0,0 +1,175 @@
+package istore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// withContentInfo returns the msgpack bytes of the item with the content
+// checksum, size and content type recorded.
+func withContentInfo(metabytes []byte, sum string, size int64, ctype string) ([]byte, error) {
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(metabytes); err != nil {
+		return nil, err
+	}
+	meta.Sha256 = sum
+	meta.Size = size
+	meta.ContentType = ctype
+
+	return meta.MarshalMsg(nil)
+}
+
+// recordContentInfo stores the content info to the existing item.
+func (s *Server) recordContentInfo(key string, sum string, size int64, ctype string) error {
+	data, err := s.Db.Get([]byte(key), nil)
+	if err != nil {
+		return err
+	}
+	metabytes, err := withContentInfo(data, sum, size, ctype)
+	if err != nil {
+		return err
+	}
+	return s.Db.Put([]byte(key), metabytes, nil)
+}
+
+// setContentHeaders exposes the recorded content info of the source object.
+func setContentHeaders(w http.ResponseWriter, meta *ItemMeta) {
+	if meta.Sha256 == "" {
+		return
+	}
+	w.Header().Set("X-Istore-Sha256", meta.Sha256)
+	w.Header().Set("X-Istore-Size", strconv.FormatInt(meta.Size, 10))
+	if meta.ContentType != "" {
+		w.Header().Set("X-Istore-Content-Type", meta.ContentType)
+	}
+}
+
+func sha256Reader(input io.Reader) (sum string, size int64, err error) {
+	hash := sha256.New()
+	size, err = io.Copy(hash, input)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+type VerifyArgs struct {
+	// Update records the current checksum to items that drifted.
+	Update bool `json:"update,omitempty"`
+}
+
+type VerifyResult struct {
+	FilePath string `json:"_filepath"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Verify re-fetches every item under the directory from its origin and
+// reports items whose content differs from the recorded checksum.  Items
+// without checksum get recorded.
+func (s *Server) Verify(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	dir = dir[0 : len(dir)-len("_verify")]
+	if !strings.HasSuffix(dir, "/") {
+		http.Error(w, "verify should finish with '/'", http.StatusBadRequest)
+		return
+	}
+
+	args := VerifyArgs{}
+	if body, err := ioutil.ReadAll(r.Body); err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, &args); err != nil {
+			http.Error(w, "unrecognized args", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// bypass the cache to see the origin
+	client := &http.Client{Transport: s}
+
+	results := []VerifyResult{}
+	counts := map[string]int{}
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		Url := extractTargetURL(key)
+		if Url == "" {
+			continue
+		}
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(iter.Value()); err != nil {
+			glog.Error("failed to unmarshal metadata from db ", err)
+			continue
+		}
+
+		result := VerifyResult{
+			FilePath: key,
+			Expected: meta.Sha256,
+		}
+		resp, err := client.Get(Url)
+		if err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				result.Status = "missing"
+			}
+		} else if resp.StatusCode != http.StatusOK {
+			result.Status = "missing"
+			result.Error = resp.Status
+			resp.Body.Close()
+		} else {
+			sum, size, err := sha256Reader(resp.Body)
+			resp.Body.Close()
+			result.Actual = sum
+			result.Size = size
+			switch {
+			case err != nil:
+				result.Status = "error"
+				result.Error = err.Error()
+			case meta.Sha256 == "":
+				result.Status = "recorded"
+			case meta.Sha256 == sum:
+				result.Status = "ok"
+			default:
+				result.Status = "changed"
+			}
+			if result.Status == "recorded" || (result.Status == "changed" && args.Update) {
+				ctype := resp.Header.Get("Content-Type")
+				if err := s.recordContentInfo(key, sum, size, ctype); err != nil {
+					glog.Error(err)
+				}
+			}
+		}
+
+		counts[result.Status]++
+		if result.Status != "ok" {
+			results = append(results, result)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header()["Content-type"] = []string{"application/json"}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(map[string]interface{}{
+		"counts":  counts,
+		"results": results,
+	}); err != nil {
+		glog.Error(err)
+	}
+}
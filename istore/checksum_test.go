@@ -0,0 +1,55 @@
+package istore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestChecksum(c *C) {
+	server := newTestServer()
+
+	// copy the sample so we can change it later
+	content, _ := ioutil.ReadFile(filepath.Join("testdata", "sample.jpg"))
+	imgfile := filepath.Join(server.Dir, "sample.jpg")
+	ioutil.WriteFile(imgfile, content, 0644)
+	sum := sha256.Sum256(content)
+	expected := hex.EncodeToString(sum[:])
+
+	mock := server.request("POST", "/path/sum/file://"+imgfile, "")
+	c.Check(mock.status, Equals, http.StatusCreated)
+
+	// the first fetch records, and the next one tells it
+	mock = server.request("GET", "/path/sum/file://"+imgfile, "")
+	c.Check(mock.status, Equals, http.StatusOK)
+	mock = server.request("GET", "/path/sum/file://"+imgfile, "")
+	c.Check(mock.header.Get("X-Istore-Sha256"), Equals, expected)
+	c.Check(mock.header.Get("X-Istore-Content-Type"), Equals, "image/jpeg")
+
+	type verifyResponse struct {
+		Counts  map[string]int `json:"counts"`
+		Results []VerifyResult `json:"results"`
+	}
+	res := verifyResponse{}
+	mock = server.request("POST", "/path/sum/_verify", "")
+	json.Unmarshal(mock.body.Bytes(), &res)
+	c.Check(res.Counts["ok"], Equals, 1)
+	c.Check(len(res.Results), Equals, 0)
+
+	// origin changes
+	os.Remove(imgfile)
+	ioutil.WriteFile(imgfile, content[:len(content)/2], 0644)
+	res = verifyResponse{}
+	mock = server.request("POST", "/path/sum/_verify", "")
+	json.Unmarshal(mock.body.Bytes(), &res)
+	c.Check(res.Counts["changed"], Equals, 1)
+	c.Assert(len(res.Results), Equals, 1)
+	c.Check(res.Results[0].Expected, Equals, expected)
+	c.Check(res.Results[0].Size, Equals, int64(len(content)/2))
+}
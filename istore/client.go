@@ -25,14 +25,22 @@ func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
 		return client.Do(req)
 	case "self":
 		return s.selfGet(req)
+	case "s3":
+		return s.s3Get(req)
+	case "blob":
+		return s.blobGet(req)
 	}
 
 	return nil, fmt.Errorf("unknown scheme %s", req.URL.Scheme)
 }
 
 func fileGet(req *http.Request) (*http.Response, error) {
-	filename := req.URL.Path
+	return serveFile(req, req.URL.Path, req.URL.Path)
+}
 
+// serveFile returns the local file content as a response.  The content type
+// is guessed from the extension of name, or sniffed from the content.
+func serveFile(req *http.Request, filename, name string) (*http.Response, error) {
 	content, err := os.Open(filename)
 	if err != nil {
 		// Return 404 if not found
@@ -61,7 +69,7 @@ func fileGet(req *http.Request) (*http.Response, error) {
 		Body:       content,
 	}
 
-	ctype := mime.TypeByExtension(filepath.Ext(filename))
+	ctype := mime.TypeByExtension(filepath.Ext(name))
 	if ctype == "" {
 		var buf [512]byte // see net/http/sniff.go
 		n, _ := io.ReadFull(content, buf[:])
@@ -76,6 +84,7 @@ func fileGet(req *http.Request) (*http.Response, error) {
 	if stat, err := content.Stat(); err == nil {
 		resp.ContentLength = stat.Size()
 		resp.Header.Set("Content-length", fmt.Sprintf("%d", stat.Size()))
+		resp.Header.Set("Last-modified", stat.ModTime().UTC().Format(http.TimeFormat))
 	} else {
 		glog.Error(err)
 	}
@@ -0,0 +1,156 @@
+package istore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CacheControl is the Cache-Control header of processed output for each
+// apply operation.  The "" entry is used for operations not listed.
+var CacheControl = map[string]string{
+	"": "max-age=1000000",
+}
+
+func cacheControlFor(apply string) string {
+	if value, ok := CacheControl[apply]; ok {
+		return value
+	}
+	return CacheControl[""]
+}
+
+var (
+	resizeParams    = []string{"w", "h", "percent", "max_w", "max_h", "upscale", "filter"}
+	fillParams      = []string{"w", "h", "anchor", "filter"}
+	padParams       = []string{"w", "h", "bg", "anchor", "filter"}
+	transcodeParams = []string{"start", "end", "format", "vcodec", "w", "h", "bitrate", "audio"}
+)
+
+// applyParams are the parameters read by each apply, so that the others,
+// e.g. a cache buster, neither change the ETag nor split the rendition
+// cache.
+var applyParams = map[string][]string{
+	"adjustBrightness": {"percentage"},
+	"adjustContrast":   {"percentage"},
+	"adjustGamma":      {"gamma"},
+	"adjustSigmoid":    {"midpoint", "factor"},
+	"adjustHue":        {"shift"},
+	"adjustSaturation": {"percentage"},
+	"blur":             {"sigma"},
+	"channel":          {"c"},
+	"colorBalance":     {"r", "g", "b"},
+	"crop":             {"x1", "y1", "x2", "y2"},
+	"drawRect":         {"rects"},
+	"overlay":          {"overlay"},
+	// setAnnotationOverlay puts the annotations to draw in overlay.
+	"annotate":     {"overlay"},
+	"fit":          resizeParams,
+	"resize":       resizeParams,
+	"fill":         fillParams,
+	"smartcrop":    fillParams,
+	"thumbnail":    fillParams,
+	"pad":          padParams,
+	"letterbox":    padParams,
+	"rotate":       {"angle", "bg"},
+	"sharpen":      {"sigmoid"},
+	"frame":        {"n", "ms", "sec", "keyframe"},
+	"contactsheet": {"n", "cols", "w", "h", "spacing", "label"},
+	"preview":      {"start", "duration", "fps", "w", "format"},
+	"clip":         transcodeParams,
+	"transcode":    transcodeParams,
+}
+
+// tensorParams are the parameters of output=npy and output=raw.
+var tensorParams = []string{"output", "dtype", "layout", "channels", "mean", "std"}
+
+// renditionQuery returns the parameters the processed output depends on,
+// sorted by key so that the order doesn't matter.
+func renditionQuery(r *http.Request) string {
+	query := r.URL.Query()
+	names := append([]string{"apply"}, applyParams[query.Get("apply")]...)
+	if query.Get("output") != "" {
+		names = append(names, tensorParams...)
+	}
+	params := url.Values{}
+	for _, name := range names {
+		if values, ok := query[name]; ok {
+			params[name] = values
+		}
+	}
+	return params.Encode()
+}
+
+// renditionETag derives a strong ETag of the processed output from the
+// validator of the source and the apply parameters.  It returns "" if the
+// source has no validator.
+func renditionETag(source http.Header, r *http.Request) string {
+	validator := source.Get("Etag")
+	if validator == "" {
+		validator = source.Get("Last-Modified")
+	}
+	if validator == "" {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(validator + "\n" + renditionQuery(r)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since of the request
+// against the response header.
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		// If-Modified-Since is ignored when If-None-Match is present.
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !modified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// notModifiedResponse makes 304 response to skip processing the content.
+func notModifiedResponse(resp *http.Response, r *http.Request, etag, cacheControl string) (*http.Response, error) {
+	resp.Body.Close()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s 304 Not Modified\n", resp.Proto)
+	fmt.Fprintf(buf, "Date: %s\n", time.Now().UTC().Format(http.TimeFormat))
+	fmt.Fprintf(buf, "Etag: %s\n", etag)
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		fmt.Fprintf(buf, "Last-Modified: %s\n", lastModified)
+	}
+	fmt.Fprintf(buf, "Cache-Control: %s\n\n", cacheControl)
+
+	return http.ReadResponse(bufio.NewReader(buf), r)
+}
@@ -0,0 +1,54 @@
+package istore
+
+import (
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestConditionalGet(c *C) {
+	server := newTestServer()
+
+	testdata := testdataFile("sample.jpg")
+
+	request := func(path string, header http.Header) *mockWriter {
+		r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		for key, values := range header {
+			r.Header[key] = values
+		}
+		return server.do(r)
+	}
+
+	server.request("POST", "/path/cond/file://"+testdata, "")
+
+	// processed rendition
+	mock := request("/path/cond/file://"+testdata+"?apply=resize&w=100", nil)
+	c.Check(mock.status, Equals, http.StatusOK)
+	etag := mock.header.Get("Etag")
+	c.Check(etag, Not(Equals), "")
+	c.Check(mock.header.Get("Cache-Control"), Equals, "max-age=1000000")
+
+	// the same parameters in the different order
+	mock = request("/path/cond/file://"+testdata+"?w=100&apply=resize", nil)
+	c.Check(mock.header.Get("Etag"), Equals, etag)
+
+	mock = request("/path/cond/file://"+testdata+"?apply=resize&w=120", nil)
+	c.Check(mock.header.Get("Etag"), Not(Equals), etag)
+
+	mock = request("/path/cond/file://"+testdata+"?apply=resize&w=100", http.Header{"If-None-Match": {etag}})
+	c.Check(mock.status, Equals, http.StatusNotModified)
+	c.Check(mock.body.Len(), Equals, 0)
+
+	// raw object
+	mock = request("/path/cond/file://"+testdata, nil)
+	lastModified := mock.header.Get("Last-Modified")
+	c.Check(lastModified, Not(Equals), "")
+	mock = request("/path/cond/file://"+testdata, http.Header{"If-Modified-Since": {lastModified}})
+	c.Check(mock.status, Equals, http.StatusNotModified)
+
+	// per operation Cache-Control
+	CacheControl["blur"] = "public, max-age=60"
+	defer delete(CacheControl, "blur")
+	mock = request("/path/cond/file://"+testdata+"?apply=blur&sigma=1", nil)
+	c.Check(mock.header.Get("Cache-Control"), Equals, "public, max-age=60")
+}
@@ -0,0 +1,171 @@
+package istore
+
+import (
+	"image"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// anchors are the positions of fill crop, as the ratio of the space left
+// on the left and top.
+var anchors = map[string][2]float64{
+	"center":      {0.5, 0.5},
+	"top":         {0.5, 0},
+	"bottom":      {0.5, 1},
+	"left":        {0, 0.5},
+	"right":       {1, 0.5},
+	"topleft":     {0, 0},
+	"topright":    {1, 0},
+	"bottomleft":  {0, 1},
+	"bottomright": {1, 1},
+}
+
+// validAnchor accepts the anchors, "smart" and "" for center.
+func validAnchor(anchor string) bool {
+	_, ok := anchors[anchor]
+	return ok || anchor == "" || anchor == "smart"
+}
+
+// fillSize returns the size of the largest rectangle of the aspect ratio
+// width:height in bounds.
+func fillSize(bounds image.Rectangle, width, height int) image.Point {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w*height > h*width {
+		w = int(math.Floor(float64(h)*float64(width)/float64(height) + 0.5))
+	} else {
+		h = int(math.Floor(float64(w)*float64(height)/float64(width) + 0.5))
+	}
+	return image.Pt(w, h)
+}
+
+// anchorRect places the fill rectangle at the anchor in bounds.
+func anchorRect(bounds image.Rectangle, width, height int, anchor string) image.Rectangle {
+	size := fillSize(bounds, width, height)
+	pos, ok := anchors[anchor]
+	if !ok {
+		pos = anchors["center"]
+	}
+	x := bounds.Min.X + int(float64(bounds.Dx()-size.X)*pos[0]+0.5)
+	y := bounds.Min.Y + int(float64(bounds.Dy()-size.Y)*pos[1]+0.5)
+	return image.Rect(x, y, x+size.X, y+size.Y)
+}
+
+// smartCropAnalysisSize is the size to downscale the image for smart crop.
+const smartCropAnalysisSize = 256
+
+// edgeEnergy returns the gradient magnitude of the luminance at each pixel.
+func edgeEnergy(m image.Image) ([]float64, int, int) {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			lum[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+		}
+	}
+
+	energy := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// differences clamped at the border
+			dx := lum[y*w+minInt(x+1, w-1)] - lum[y*w+maxInt(x-1, 0)]
+			dy := lum[minInt(y+1, h-1)*w+x] - lum[maxInt(y-1, 0)*w+x]
+			energy[y*w+x] = math.Abs(dx) + math.Abs(dy)
+		}
+	}
+	return energy, w, h
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// smartCropRect places the fill rectangle where the edge energy is the
+// largest, which tends to cover the subject rather than the flat
+// background.  Ties go to the one nearest to the center.
+func smartCropRect(m image.Image, width, height int) image.Rectangle {
+	bounds := m.Bounds()
+	size := fillSize(bounds, width, height)
+	small := imaging.Fit(m, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	energy, sw, sh := edgeEnergy(small)
+	scale := float64(bounds.Dx()) / float64(sw)
+
+	// The rectangle slides along one axis only, so project the energy.
+	horizontal := size.X < bounds.Dx()
+	n := sh
+	if horizontal {
+		n = sw
+	}
+	prefix := make([]float64, n+1)
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			i := y
+			if horizontal {
+				i = x
+			}
+			prefix[i+1] += energy[y*sw+x]
+		}
+	}
+	for i := 0; i < n; i++ {
+		prefix[i+1] += prefix[i]
+	}
+
+	window := int(float64(size.Y)/scale + 0.5)
+	space := bounds.Dy() - size.Y
+	if horizontal {
+		window = int(float64(size.X)/scale + 0.5)
+		space = bounds.Dx() - size.X
+	}
+	window = minInt(maxInt(window, 1), n)
+
+	best, bestEnergy, center := 0, -1.0, float64(n-window)/2
+	for offset := 0; offset+window <= n; offset++ {
+		e := prefix[offset+window] - prefix[offset]
+		if e > bestEnergy || (e == bestEnergy && math.Abs(float64(offset)-center) < math.Abs(float64(best)-center)) {
+			best, bestEnergy = offset, e
+		}
+	}
+
+	pos := minInt(int(float64(best)*scale+0.5), space)
+	if horizontal {
+		return image.Rect(0, 0, size.X, size.Y).Add(bounds.Min.Add(image.Pt(pos, 0)))
+	}
+	return image.Rect(0, 0, size.X, size.Y).Add(bounds.Min.Add(image.Pt(0, pos)))
+}
+
+// fillImage resizes m to cover width x height and crops it at the anchor.
+func fillImage(m image.Image, width, height int, anchor string, filter imaging.ResampleFilter) image.Image {
+	var rect image.Rectangle
+	if anchor == "smart" {
+		rect = smartCropRect(m, width, height)
+	} else {
+		rect = anchorRect(m.Bounds(), width, height, anchor)
+	}
+	return imaging.Resize(imaging.Crop(m, rect), width, height, filter)
+}
+
+func fill(input io.Reader, width, height int, anchor string, filter imaging.ResampleFilter) ([]byte, error) {
+	if width <= 0 || height <= 0 {
+		return nil, badRequest("invalid size %dx%d", width, height)
+	}
+	if !validAnchor(anchor) {
+		return nil, badRequest("unknown anchor %q", anchor)
+	}
+	size := func(image.Point) image.Point { return image.Pt(width, height) }
+	return processImageSize(input, size, func(m image.Image) image.Image {
+		return fillImage(m, width, height, anchor, filter)
+	})
+}
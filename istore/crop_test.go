@@ -0,0 +1,61 @@
+package istore
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestFill(c *C) {
+	bounds := image.Rect(0, 0, 300, 200)
+	c.Check(anchorRect(bounds, 100, 100, ""), Equals, image.Rect(50, 0, 250, 200))
+	c.Check(anchorRect(bounds, 100, 100, "left"), Equals, image.Rect(0, 0, 200, 200))
+	c.Check(anchorRect(bounds, 300, 100, "bottomright"), Equals, image.Rect(0, 100, 300, 200))
+	c.Check(anchorRect(bounds, 300, 100, "top"), Equals, image.Rect(0, 0, 300, 100))
+	c.Check(validAnchor("smart"), Equals, true)
+	c.Check(validAnchor("middle"), Equals, false)
+
+	// flat on the left, and the detail on the right
+	m := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	for y := 40; y < 160; y += 8 {
+		for x := 300; x < 380; x += 8 {
+			draw.Draw(m, image.Rect(x, y, x+4, y+4), image.NewUniform(color.Black), image.ZP, draw.Src)
+		}
+	}
+	rect := smartCropRect(m, 100, 100)
+	c.Check(rect.Size(), Equals, image.Pt(200, 200))
+	// covers the detail at 300 - 376
+	c.Check(rect.Min.X <= 300 && rect.Max.X >= 376, Equals, true, Commentf("%v", rect))
+
+	// ties go to the center
+	flat := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	c.Check(smartCropRect(flat, 100, 100), Equals, image.Rect(100, 0, 300, 200))
+
+	c.Check(fillImage(m, 50, 80, "smart", imaging.Linear).Bounds(), Equals, image.Rect(0, 0, 50, 80))
+}
+
+func (_ *S) TestFillArgs(c *C) {
+	server := newTestServer()
+	item := "/path/fill/file://" + testdataFile("sample.jpg")
+	server.request("POST", item, "")
+
+	mock := server.request("GET", item+"?apply=thumbnail&w=50&h=40", "")
+	c.Assert(mock.status, Equals, http.StatusOK)
+	m, _, err := image.Decode(bytes.NewReader(mock.body.Bytes()))
+	c.Assert(err, IsNil)
+	c.Check(m.Bounds().Size(), Equals, image.Pt(50, 40))
+
+	for _, query := range []string{
+		"apply=fill&w=abc&h=40", "apply=fill&w=50", "apply=fill&w=100000&h=40",
+		"apply=smartcrop&w=50&h=-1", "apply=fill&w=50&h=40&anchor=middle",
+	} {
+		mock := server.request("GET", item+"?"+query, "")
+		c.Check(mock.status, Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
@@ -0,0 +1,282 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	_ExifTagMake             = 0x010f
+	_ExifTagModel            = 0x0110
+	_ExifTagOrientation      = 0x0112
+	_ExifTagDateTime         = 0x0132
+	_ExifTagExifIFD          = 0x8769
+	_ExifTagGPSIFD           = 0x8825
+	_ExifTagDateTimeOriginal = 0x9003
+	_ExifTagOffsetTime       = 0x9011
+
+	_GPSTagLatitudeRef  = 0x0001
+	_GPSTagLatitude     = 0x0002
+	_GPSTagLongitudeRef = 0x0003
+	_GPSTagLongitude    = 0x0004
+	_GPSTagAltitudeRef  = 0x0005
+	_GPSTagAltitude     = 0x0006
+)
+
+// byte size of each TIFF field type
+var tiffTypeSize = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	7:  1, // UNDEFINED
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+}
+
+var errInvalidTiff = errors.New("invalid tiff structure")
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]tiffEntry, error) {
+	data := t.data
+	if int(offset)+2 > len(data) {
+		return nil, errInvalidTiff
+	}
+	n := int(t.order.Uint16(data[offset:]))
+	entries := map[uint16]tiffEntry{}
+	for i := 0; i < n; i++ {
+		pos := int(offset) + 2 + i*12
+		if pos+12 > len(data) {
+			return nil, errInvalidTiff
+		}
+		tag := t.order.Uint16(data[pos:])
+		entry := tiffEntry{
+			typ:   t.order.Uint16(data[pos+2:]),
+			count: t.order.Uint32(data[pos+4:]),
+		}
+		size, ok := tiffTypeSize[entry.typ]
+		if !ok {
+			continue
+		}
+		length := size * int(entry.count)
+		if length < 0 || length > len(data) {
+			return nil, errInvalidTiff
+		}
+		if length <= 4 {
+			entry.value = data[pos+8 : pos+8+length]
+		} else {
+			valoff := int(t.order.Uint32(data[pos+8:]))
+			if valoff+length > len(data) {
+				return nil, errInvalidTiff
+			}
+			entry.value = data[valoff : valoff+length]
+		}
+		entries[tag] = entry
+	}
+	return entries, nil
+}
+
+func (t *tiffReader) String(entry tiffEntry) string {
+	s := string(entry.value)
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func (t *tiffReader) Uint(entry tiffEntry) (uint32, bool) {
+	switch {
+	case entry.typ == 1 && len(entry.value) >= 1:
+		return uint32(entry.value[0]), true
+	case entry.typ == 3 && len(entry.value) >= 2:
+		return uint32(t.order.Uint16(entry.value)), true
+	case entry.typ == 4 && len(entry.value) >= 4:
+		return t.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+func (t *tiffReader) Rationals(entry tiffEntry) []float64 {
+	if entry.typ != 5 && entry.typ != 10 {
+		return nil
+	}
+	values := []float64{}
+	for i := 0; i+8 <= len(entry.value); i += 8 {
+		num := t.order.Uint32(entry.value[i:])
+		den := t.order.Uint32(entry.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		if entry.typ == 10 {
+			values = append(values, float64(int32(num))/float64(int32(den)))
+		} else {
+			values = append(values, float64(num)/float64(den))
+		}
+	}
+	return values
+}
+
+// jpegExif returns the TIFF structure in the Exif APP1 segment of JPEG,
+// or nil if there isn't.
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8):
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// Exif must come before the image data
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// exifTime converts "2006:01:02 15:04:05" to "2006-01-02T15:04:05".
+func exifTime(s string) string {
+	if len(s) != 19 {
+		return ""
+	}
+	return strings.Replace(s[:10], ":", "-", -1) + "T" + s[11:]
+}
+
+// parseExif extracts orientation, camera, capture time and GPS position
+// from the Exif TIFF structure.
+func parseExif(data []byte) (map[string]interface{}, error) {
+	if len(data) < 8 {
+		return nil, errInvalidTiff
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown byte order %q", data[:2])
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, errInvalidTiff
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := map[string]interface{}{}
+	if entry, ok := ifd0[_ExifTagOrientation]; ok {
+		if v, ok := t.Uint(entry); ok {
+			exif["orientation"] = int64(v)
+		}
+	}
+	if entry, ok := ifd0[_ExifTagMake]; ok {
+		exif["make"] = t.String(entry)
+	}
+	if entry, ok := ifd0[_ExifTagModel]; ok {
+		exif["model"] = t.String(entry)
+	}
+	if entry, ok := ifd0[_ExifTagDateTime]; ok {
+		if v := exifTime(t.String(entry)); v != "" {
+			exif["capture_time"] = v
+		}
+	}
+
+	if entry, ok := ifd0[_ExifTagExifIFD]; ok {
+		offset, _ := t.Uint(entry)
+		if sub, err := t.readIFD(offset); err == nil {
+			if entry, ok := sub[_ExifTagDateTimeOriginal]; ok {
+				if v := exifTime(t.String(entry)); v != "" {
+					if entry, ok := sub[_ExifTagOffsetTime]; ok {
+						v += t.String(entry)
+					}
+					exif["capture_time"] = v
+				}
+			}
+		}
+	}
+
+	if entry, ok := ifd0[_ExifTagGPSIFD]; ok {
+		offset, _ := t.Uint(entry)
+		if sub, err := t.readIFD(offset); err == nil {
+			if gps := parseGPS(t, sub); len(gps) > 0 {
+				exif["gps"] = gps
+			}
+		}
+	}
+
+	return exif, nil
+}
+
+func parseGPS(t *tiffReader, ifd map[uint16]tiffEntry) map[string]interface{} {
+	// degrees, minutes and seconds
+	degrees := func(tag uint16, negRef string, refTag uint16) (float64, bool) {
+		entry, ok := ifd[tag]
+		if !ok {
+			return 0, false
+		}
+		dms := t.Rationals(entry)
+		if len(dms) != 3 {
+			return 0, false
+		}
+		deg := dms[0] + dms[1]/60 + dms[2]/3600
+		if ref, ok := ifd[refTag]; ok && t.String(ref) == negRef {
+			deg = -deg
+		}
+		return deg, true
+	}
+
+	gps := map[string]interface{}{}
+	if lat, ok := degrees(_GPSTagLatitude, "S", _GPSTagLatitudeRef); ok {
+		gps["latitude"] = lat
+	}
+	if lng, ok := degrees(_GPSTagLongitude, "W", _GPSTagLongitudeRef); ok {
+		gps["longitude"] = lng
+	}
+	if entry, ok := ifd[_GPSTagAltitude]; ok {
+		if alt := t.Rationals(entry); len(alt) == 1 {
+			// reference 1 means below sea level
+			if ref, ok := ifd[_GPSTagAltitudeRef]; ok {
+				if v, _ := t.Uint(ref); v == 1 {
+					alt[0] = -alt[0]
+				}
+			}
+			gps["altitude"] = alt[0]
+		}
+	}
+	return gps
+}
@@ -0,0 +1,54 @@
+package istore
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestFrameDifference(c *C) {
+	black := imaging.New(320, 240, color.Black)
+	white := imaging.New(320, 240, color.White)
+	half := imaging.Paste(imaging.Clone(black), imaging.New(160, 240, color.White), image.Pt(0, 0))
+
+	c.Check(frameDifference(sceneThumbnail(black), sceneThumbnail(black)), Equals, 0.0)
+	c.Check(frameDifference(sceneThumbnail(black), sceneThumbnail(white)), Equals, 1.0)
+	diff := frameDifference(sceneThumbnail(black), sceneThumbnail(half))
+	c.Check(diff > 0.45 && diff < 0.55, Equals, true)
+}
+
+func (_ *S) TestExpandArgs(c *C) {
+	server := newTestServer()
+	video := "/path/video/file://" + testdataFile("sample.avi")
+
+	mock := server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "fps": 2, "interval": 1}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "fps": -1}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+
+	// sample.avi is at 5 fps
+	mock = server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "fps": 5}`)
+	c.Check(mock.status, Equals, http.StatusOK)
+	mock = server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "fps": 1000000}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "interval": 0.001}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+}
+
+func (_ *S) TestMaxExpandFrames(c *C) {
+	defer func(n int) { MaxExpandFrames = n }(MaxExpandFrames)
+	MaxExpandFrames = 5
+	server := newTestServer()
+	video := "/path/video/file://" + testdataFile("sample.avi")
+
+	// 10 frames of 2 seconds
+	mock := server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "fps": 5}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "fps": 5, "max_frames": 5}`)
+	c.Check(mock.status, Equals, http.StatusOK)
+	mock = server.request("POST", "/path/frames/_expand", `{"video": "`+video+`", "keyframes": true}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,285 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF8"))
+}
+
+// gifFrameDelays reads the delay of each frame of GIF in 1/100 seconds by
+// skipping the blocks, without decoding them.  It returns nil unless data
+// is GIF.
+func gifFrameDelays(data []byte) []int {
+	// header and logical screen descriptor
+	if !isGIF(data) || len(data) < 13 {
+		return nil
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&7 + 1)
+	}
+
+	// skipSubBlocks returns the position after the block terminator.
+	skipSubBlocks := func(pos int) int {
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		return pos + 1
+	}
+
+	delays := []int{}
+	delay := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// graphic control extension has the delay of the next frame
+			if pos+8 <= len(data) && data[pos+1] == 0xf9 && data[pos+2] == 4 {
+				delay = int(data[pos+4]) | int(data[pos+5])<<8
+			}
+			// extension with the label
+			pos = skipSubBlocks(pos + 2)
+		case 0x2c:
+			// image descriptor, local color table and LZW minimum code size
+			if pos+10 > len(data) {
+				return delays
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos = skipSubBlocks(pos + 1)
+			delays = append(delays, delay)
+			delay = 0
+		default:
+			// trailer or broken
+			return delays
+		}
+	}
+	return delays
+}
+
+// gifCanvases composites each frame onto the logical screen, following the
+// disposal method of the previous frame, so that every frame can be
+// processed independently.
+func gifCanvases(g *gif.GIF) []*image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(bounds)
+	canvases := make([]*image.RGBA, 0, len(g.Image))
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		snapshot := image.NewRGBA(bounds)
+		draw.Draw(snapshot, bounds, canvas, bounds.Min, draw.Src)
+		canvases = append(canvases, snapshot)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return canvases
+}
+
+// toPaletted quantizes the image for GIF.  Transparent pixels are kept
+// transparent.
+func toPaletted(m image.Image) *image.Paletted {
+	b := m.Bounds()
+	transparent := false
+	for y := b.Min.Y; y < b.Max.Y && !transparent; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a < 0x8000 {
+				transparent = true
+				break
+			}
+		}
+	}
+
+	pal := color.Palette(palette.Plan9)
+	if transparent {
+		pal = append(color.Palette{}, palette.Plan9[:255]...)
+		pal = append(pal, color.RGBA{})
+	}
+	pm := image.NewPaletted(b, pal)
+	draw.FloydSteinberg.Draw(pm, b, m, b.Min)
+	if transparent {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if _, _, _, a := m.At(x, y).RGBA(); a < 0x8000 {
+					pm.SetColorIndex(x, y, uint8(len(pal)-1))
+				}
+			}
+		}
+	}
+	return pm
+}
+
+// processGIF applies mainProc to every frame of animated GIF, keeping the
+// delays and loop count.  The frames are composited, so each of them
+// replaces the previous one.
+func processGIF(g *gif.GIF, mainProc func(image.Image) image.Image) ([]byte, error) {
+	out := &gif.GIF{
+		Delay:     g.Delay,
+		LoopCount: g.LoopCount,
+	}
+	for _, canvas := range gifCanvases(g) {
+		out.Image = append(out.Image, toPaletted(mainProc(canvas)))
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gifTimestamps returns the start time of each frame in seconds.
+func gifTimestamps(delays []int) []float64 {
+	timestamps := make([]float64, len(delays))
+	sec := 0.0
+	for i, delay := range delays {
+		timestamps[i] = sec
+		// delay is in 1/100 seconds
+		sec += float64(delay) / 100
+	}
+	return timestamps
+}
+
+// gifFrame extracts the frame of GIF as PNG, by index or by time.  It
+// returns the start time of the frame as well.
+func gifFrame(input io.Reader, opts *frameOptions) ([]byte, float64, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, 0, err
+	}
+	timestamps := gifTimestamps(gifFrameDelays(data))
+
+	n := opts.N
+	if n < 0 {
+		// the last frame starting at or before the time
+		n = 0
+		for i, ts := range timestamps {
+			if ts <= opts.Sec {
+				n = i
+			}
+		}
+	}
+	if n >= len(timestamps) {
+		return nil, 0, fmt.Errorf("frame %d not found in %d frames", n, len(timestamps))
+	}
+
+	_, release, err := acquireImage(data, len(timestamps))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	if n >= len(g.Image) {
+		return nil, 0, fmt.Errorf("frame %d not found in %d frames", n, len(g.Image))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, gifCanvases(g)[n]); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), timestamps[n], nil
+}
+
+// expandGIF registers the frames of animated GIF in the range, up to
+// MaxFrames evenly.
+func expandGIF(s *Server, input io.Reader, dir, objkey string, args *ExpandArgs, h *jobHandle) error {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	// the frames are not decoded but the size is checked for them
+	if _, err := checkImage(data); err != nil {
+		return err
+	}
+	delays := gifFrameDelays(data)
+	if err := checkFrames(len(delays)); err != nil {
+		return err
+	}
+	timestamps := gifTimestamps(delays)
+
+	indices := []int{}
+	for i, ts := range timestamps {
+		if ts >= args.Start && (args.End <= 0 || ts <= args.End) {
+			indices = append(indices, i)
+		}
+	}
+	if args.MaxFrames > 0 && len(indices) > args.MaxFrames {
+		sampled := make([]int, args.MaxFrames)
+		for j := range sampled {
+			sampled[j] = indices[j*len(indices)/args.MaxFrames]
+		}
+		indices = sampled
+	}
+
+	batch := new(leveldb.Batch)
+	// format with padding so path key order agrees with our intension.
+	format := "?apply=frame&n=%0" + strconv.Itoa(len(strconv.Itoa(len(delays)-1))) + "d"
+	for j, i := range indices {
+		if h.Canceled() {
+			return errJobCanceled
+		}
+		h.SetProgress(float64(j) / float64(len(indices)))
+
+		key := dir + selfURL(objkey) + fmt.Sprintf(format, i)
+		meta := map[string]interface{}{
+			"n":     i,
+			"sec":   timestamps[i],
+			"image": objkey,
+		}
+		meta["delay"] = float64(delays[i]) / 100
+		value, _ := json.Marshal(&meta)
+		if _, _, err := s.PutObject([]byte(key), string(value), batch, true); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Db.Write(batch, nil); err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
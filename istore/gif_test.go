@@ -0,0 +1,101 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// makeAnimatedGIF makes 4x2 GIF of 2 frames.  The second frame updates
+// only the right half.
+func makeAnimatedGIF() []byte {
+	first := image.NewPaletted(image.Rect(0, 0, 4, 2), palette.Plan9)
+	for i := range first.Pix {
+		first.Pix[i] = uint8(first.Palette.Index(color.RGBA{255, 0, 0, 255}))
+	}
+	second := image.NewPaletted(image.Rect(2, 0, 4, 2), palette.Plan9)
+	for i := range second.Pix {
+		second.Pix[i] = uint8(second.Palette.Index(color.RGBA{0, 0, 255, 255}))
+	}
+
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, &gif.GIF{
+		Image:    []*image.Paletted{first, second},
+		Delay:    []int{10, 20},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{Width: 4, Height: 2},
+	})
+	return buf.Bytes()
+}
+
+func (_ *S) TestAnimatedGIF(c *C) {
+	data := makeAnimatedGIF()
+	c.Check(gifFrameDelays(data), DeepEquals, []int{10, 20})
+	c.Check(gifFrameDelays(data[:len(data)-1]), DeepEquals, []int{10, 20})
+	c.Check(gifFrameDelays([]byte("GIF89a")), IsNil)
+
+	output, err := flipH(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	g, err := gif.DecodeAll(bytes.NewReader(output))
+	c.Assert(err, IsNil)
+	c.Assert(len(g.Image), Equals, 2)
+	c.Check(g.Delay, DeepEquals, []int{10, 20})
+	// the composited frames replace the previous ones
+	c.Check(g.Disposal, DeepEquals, []byte{gif.DisposalBackground, gif.DisposalBackground})
+	c.Check(g.Image[1].Bounds(), Equals, image.Rect(0, 0, 4, 2))
+	// the second frame is composited and flipped
+	r, _, b, _ := g.Image[1].At(0, 0).RGBA()
+	c.Check(r>>8, Equals, uint32(0))
+	c.Check(b>>8, Equals, uint32(255))
+	r, _, b, _ = g.Image[1].At(3, 0).RGBA()
+	c.Check(r>>8, Equals, uint32(255))
+	c.Check(b>>8, Equals, uint32(0))
+
+	// by time
+	output, ts, err := gifFrame(bytes.NewReader(data), &frameOptions{N: -1, Sec: 0.15})
+	c.Assert(err, IsNil)
+	c.Check(ts, Equals, 0.1)
+	m, err := png.Decode(bytes.NewReader(output))
+	c.Assert(err, IsNil)
+	c.Check(m.Bounds(), Equals, image.Rect(0, 0, 4, 2))
+	r, _, _, _ = m.At(0, 0).RGBA()
+	c.Check(r>>8, Equals, uint32(255))
+}
+
+func (_ *S) TestExpandGIF(c *C) {
+	server := newTestServer()
+	giffile := filepath.Join(server.Dir, "anim.gif")
+	ioutil.WriteFile(giffile, makeAnimatedGIF(), 0644)
+
+	mock := server.request("POST", "/path/anim/file://"+giffile, "")
+	c.Check(mock.status, Equals, http.StatusCreated)
+	server.request("POST", "/path/frames/_expand", `{"image": "/path/anim/file://`+giffile+`"}`)
+
+	items := []ItemMeta{}
+	mock = server.request("GET", "/path/frames/", "")
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &items), IsNil)
+	c.Assert(len(items), Equals, 2)
+	c.Check(strings.HasSuffix(items[1].FilePath, "?apply=frame&n=1"), Equals, true)
+	c.Check(items[1].MetaData["sec"], Equals, 0.1)
+	c.Check(items[1].MetaData["delay"], Equals, 0.2)
+}
+
+func (_ *S) TestMaxGIFFrames(c *C) {
+	defer func(n int) { MaxGIFFrames = n }(MaxGIFFrames)
+	MaxGIFFrames = 1
+
+	_, err := flipH(bytes.NewReader(makeAnimatedGIF()))
+	c.Check(errorStatus(err, nil), Equals, http.StatusRequestEntityTooLarge)
+	_, _, err = gifFrame(bytes.NewReader(makeAnimatedGIF()), &frameOptions{N: 0})
+	c.Check(errorStatus(err, nil), Equals, http.StatusRequestEntityTooLarge)
+}
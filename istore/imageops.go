@@ -0,0 +1,330 @@
+package istore
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+func rotate90(input io.Reader) ([]byte, error) {
+	return processImage(input, func(m image.Image) image.Image {
+		return imaging.Rotate90(m)
+	})
+}
+
+func rotate180(input io.Reader) ([]byte, error) {
+	return processImage(input, func(m image.Image) image.Image {
+		return imaging.Rotate180(m)
+	})
+}
+
+func rotate270(input io.Reader) ([]byte, error) {
+	return processImage(input, func(m image.Image) image.Image {
+		return imaging.Rotate270(m)
+	})
+}
+
+// rotateImage rotates m counterclockwise by angle in degrees, like
+// imaging.Rotate90.  The output is enlarged to hold the whole image, and
+// the corners are filled with bg.
+func rotateImage(m image.Image, angle float64, bg color.NRGBA) image.Image {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	switch angle {
+	case 0:
+		return m
+	case 90:
+		return imaging.Rotate90(m)
+	case 180:
+		return imaging.Rotate180(m)
+	case 270:
+		return imaging.Rotate270(m)
+	}
+	return rotateBilinear(m, angle, bg)
+}
+
+// rotatedSize returns the size of the image of size rotated by angle.
+func rotatedSize(size image.Point, angle float64) image.Point {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	w, h := float64(size.X), float64(size.Y)
+	// round off the error of sin and cos, e.g. 90 degrees
+	return image.Pt(
+		int(math.Ceil(math.Abs(w*cos)+math.Abs(h*sin)-1e-9)),
+		int(math.Ceil(math.Abs(w*sin)+math.Abs(h*cos)-1e-9)))
+}
+
+// rotateBilinear rotates m by any angle, interpolating bilinearly.
+func rotateBilinear(m image.Image, angle float64, bg color.NRGBA) *image.NRGBA {
+	src := imaging.Clone(m)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	size := rotatedSize(image.Pt(sw, sh), angle)
+	dw, dh := size.X, size.Y
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	// premultiplied color of the pixel, or bg outside
+	bgp := [4]float64{
+		float64(bg.R) * float64(bg.A) / 255, float64(bg.G) * float64(bg.A) / 255,
+		float64(bg.B) * float64(bg.A) / 255, float64(bg.A),
+	}
+	pixel := func(x, y int) [4]float64 {
+		if x < 0 || y < 0 || x >= sw || y >= sh {
+			return bgp
+		}
+		i := y*src.Stride + x*4
+		a := float64(src.Pix[i+3])
+		return [4]float64{
+			float64(src.Pix[i]) * a / 255, float64(src.Pix[i+1]) * a / 255,
+			float64(src.Pix[i+2]) * a / 255, a,
+		}
+	}
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// the center of the pixel from the center of the output,
+			// rotated back to the source
+			cx, cy := float64(x)+0.5-float64(dw)/2, float64(y)+0.5-float64(dh)/2
+			sx := cx*cos - cy*sin + float64(sw)/2 - 0.5
+			sy := cx*sin + cy*cos + float64(sh)/2 - 0.5
+
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			p00, p10 := pixel(x0, y0), pixel(x0+1, y0)
+			p01, p11 := pixel(x0, y0+1), pixel(x0+1, y0+1)
+			var c [4]float64
+			for k := range c {
+				c[k] = (p00[k]*(1-fx)+p10[k]*fx)*(1-fy) + (p01[k]*(1-fx)+p11[k]*fx)*fy
+			}
+
+			i := y*dst.Stride + x*4
+			if c[3] > 0 {
+				for k := 0; k < 3; k++ {
+					dst.Pix[i+k] = uint8(math.Min(c[k]*255/c[3]+0.5, 255))
+				}
+			}
+			dst.Pix[i+3] = uint8(c[3] + 0.5)
+		}
+	}
+	return dst
+}
+
+func rotate(input io.Reader, angle float64, bg color.NRGBA) ([]byte, error) {
+	if math.IsNaN(angle) || math.IsInf(angle, 0) {
+		return nil, badRequest("invalid angle %v", angle)
+	}
+	size := func(src image.Point) image.Point {
+		return rotatedSize(src, angle)
+	}
+	return processImageSize(input, size, func(m image.Image) image.Image {
+		return rotateImage(m, angle, bg)
+	})
+}
+
+// padImage places m at the anchor of the canvas of width x height filled
+// with bg.  m is shrunk to fit if larger, or enlarged as well if scale is
+// true (letterboxing).
+func padImage(m image.Image, width, height int, anchor string, bg color.NRGBA, scale bool, filter imaging.ResampleFilter) image.Image {
+	opts := &resizeOptions{Width: width, Height: height, Fit: true, Upscale: scale, Filter: filter}
+	m = resizeImage(m, opts)
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	b := m.Bounds()
+	pos, ok := anchors[anchor]
+	if !ok {
+		pos = anchors["center"]
+	}
+	pt := image.Pt(int(float64(width-b.Dx())*pos[0]+0.5), int(float64(height-b.Dy())*pos[1]+0.5))
+	draw.Draw(canvas, b.Sub(b.Min).Add(pt), m, b.Min, draw.Over)
+	return canvas
+}
+
+func pad(input io.Reader, width, height int, anchor string, bg color.NRGBA, scale bool, filter imaging.ResampleFilter) ([]byte, error) {
+	if width <= 0 || height <= 0 {
+		return nil, badRequest("invalid size %dx%d", width, height)
+	}
+	if _, ok := anchors[anchor]; !ok && anchor != "" {
+		return nil, badRequest("unknown anchor %q", anchor)
+	}
+	size := func(image.Point) image.Point { return image.Pt(width, height) }
+	return processImageSize(input, size, func(m image.Image) image.Image {
+		return padImage(m, width, height, anchor, bg, scale, filter)
+	})
+}
+
+// rgbToHSL converts the color in 0.0 - 1.0 to hue in degrees, saturation
+// and lightness.
+func rgbToHSL(r, g, b float64) (float64, float64, float64) {
+	max, min := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l := (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+	d := max - min
+	s := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d+6, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60, s, l
+}
+
+func hslToRGB(h, s, l float64) (float64, float64, float64) {
+	c := (1 - math.Abs(2*l-1)) * s
+	hh := math.Mod(h, 360)
+	if hh < 0 {
+		hh += 360
+	}
+	hh /= 60
+	x := c * (1 - math.Abs(math.Mod(hh, 2)-1))
+	var r, g, b float64
+	switch int(hh) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	m := l - c/2
+	return r + m, g + m, b + m
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Min(math.Max(v*255+0.5, 0), 255))
+}
+
+// adjustHSL shifts the hue by degrees and changes the saturation by the
+// percentage (-100 makes it gray).
+func adjustHSL(m image.Image, hue, saturation float64) image.Image {
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		h, s, l := rgbToHSL(float64(c.R)/255, float64(c.G)/255, float64(c.B)/255)
+		s = math.Min(s*(1+saturation/100), 1)
+		r, g, b := hslToRGB(h+hue, s, l)
+		return color.NRGBA{clampUint8(r), clampUint8(g), clampUint8(b), c.A}
+	})
+}
+
+func adjustSaturation(input io.Reader, percentage float64) ([]byte, error) {
+	if percentage < -100 {
+		return nil, badRequest("percentage should be >= -100: %v", percentage)
+	}
+	return processImage(input, func(m image.Image) image.Image {
+		return adjustHSL(m, 0, percentage)
+	})
+}
+
+func adjustHue(input io.Reader, shift float64) ([]byte, error) {
+	if math.IsNaN(shift) || math.IsInf(shift, 0) {
+		return nil, badRequest("invalid shift %v", shift)
+	}
+	return processImage(input, func(m image.Image) image.Image {
+		return adjustHSL(m, shift, 0)
+	})
+}
+
+// colorBalance scales each channel by the percentage, -100 or more.
+func colorBalance(input io.Reader, r, g, b float64) ([]byte, error) {
+	if r < -100 || g < -100 || b < -100 {
+		return nil, badRequest("percentage should be >= -100: %v, %v, %v", r, g, b)
+	}
+	return processImage(input, func(m image.Image) image.Image {
+		return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+			return color.NRGBA{
+				clampUint8(float64(c.R) / 255 * (1 + r/100)),
+				clampUint8(float64(c.G) / 255 * (1 + g/100)),
+				clampUint8(float64(c.B) / 255 * (1 + b/100)),
+				c.A,
+			}
+		})
+	})
+}
+
+// equalizeImage equalizes the histogram of the luma, keeping the chroma.
+func equalizeImage(m image.Image) image.Image {
+	src := imaging.Clone(m)
+	hist := [256]int{}
+	for i := 0; i < len(src.Pix); i += 4 {
+		y, _, _ := color.RGBToYCbCr(src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+		hist[y]++
+	}
+
+	total, cdfMin := len(src.Pix)/4, 0
+	for _, n := range hist {
+		if n > 0 {
+			cdfMin = n
+			break
+		}
+	}
+	if total == cdfMin {
+		// flat image
+		return src
+	}
+	lut := [256]uint8{}
+	cdf := 0
+	for v, n := range hist {
+		cdf += n
+		lut[v] = clampUint8(float64(cdf-cdfMin) / float64(total-cdfMin))
+	}
+
+	for i := 0; i < len(src.Pix); i += 4 {
+		y, cb, cr := color.RGBToYCbCr(src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2] = color.YCbCrToRGB(lut[y], cb, cr)
+	}
+	return src
+}
+
+func equalize(input io.Reader) ([]byte, error) {
+	return processImage(input, equalizeImage)
+}
+
+// channelImage extracts the channel r, g, b, a or l (luma) as grayscale.
+func channelImage(m image.Image, channel string) image.Image {
+	src := imaging.Clone(m)
+	dst := image.NewGray(src.Bounds())
+	for i := 0; i < len(src.Pix); i += 4 {
+		var v uint8
+		switch channel {
+		case "r":
+			v = src.Pix[i]
+		case "g":
+			v = src.Pix[i+1]
+		case "b":
+			v = src.Pix[i+2]
+		case "a":
+			v = src.Pix[i+3]
+		default:
+			v, _, _ = color.RGBToYCbCr(src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+		}
+		dst.Pix[i/4] = v
+	}
+	return dst
+}
+
+func channel(input io.Reader, c string) ([]byte, error) {
+	switch c {
+	case "r", "g", "b", "a", "l":
+	default:
+		return nil, badRequest("unknown channel %q", c)
+	}
+	return processImage(input, func(m image.Image) image.Image {
+		return channelImage(m, c)
+	})
+}
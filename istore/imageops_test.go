@@ -0,0 +1,121 @@
+package istore
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestRotate(c *C) {
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 10)
+	}
+	m.Pix[3], m.Pix[7] = 255, 255
+
+	// the interpolation agrees with the exact rotation
+	c.Check(rotateBilinear(m, 90, color.NRGBA{}), DeepEquals, imaging.Rotate90(m))
+	c.Check(rotateBilinear(m, 180, color.NRGBA{}), DeepEquals, imaging.Rotate180(m))
+	c.Check(rotateImage(m, -90, color.NRGBA{}), DeepEquals, imaging.Rotate270(m))
+
+	square := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	rotated := rotateImage(square, 45, color.NRGBA{0, 255, 0, 255})
+	c.Check(rotated.Bounds(), Equals, image.Rect(0, 0, 15, 15))
+	c.Check(rotated.At(0, 0), Equals, color.NRGBA{0, 255, 0, 255})
+}
+
+func (_ *S) TestPad(c *C) {
+	black := color.NRGBA{0, 0, 0, 255}
+	m := imaging.New(40, 20, black)
+	bg := color.NRGBA{114, 114, 114, 255}
+
+	padded := padImage(m, 100, 100, "", bg, false, imaging.Linear)
+	c.Check(padded.Bounds(), Equals, image.Rect(0, 0, 100, 100))
+	c.Check(padded.At(30, 39), Equals, bg)
+	c.Check(padded.At(30, 40), Equals, black)
+	c.Check(padded.At(69, 59), Equals, black)
+	c.Check(padded.At(69, 60), Equals, bg)
+
+	// letterbox enlarges to 100x50
+	padded = padImage(m, 100, 100, "top", bg, true, imaging.Linear)
+	c.Check(padded.At(99, 49), Equals, black)
+	c.Check(padded.At(99, 50), Equals, bg)
+}
+
+func (_ *S) TestPadArgs(c *C) {
+	server := newTestServer()
+	item := "/path/pad/file://" + testdataFile("sample.jpg")
+	server.request("POST", item, "")
+
+	mock := server.request("GET", item+"?apply=letterbox&w=64&h=64", "")
+	c.Check(mock.status, Equals, http.StatusOK)
+	for _, query := range []string{
+		"apply=pad&w=abc&h=64", "apply=pad&w=64", "apply=letterbox&w=100000&h=64",
+		"apply=pad&w=64&h=64&anchor=middle", "apply=pad&w=64&h=64&bg=gray",
+	} {
+		mock := server.request("GET", item+"?"+query, "")
+		c.Check(mock.status, Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
+
+func (_ *S) TestImageOpsArgs(c *C) {
+	server := newTestServer()
+	item := "/path/ops/file://" + testdataFile("sample.jpg")
+	server.request("POST", item, "")
+
+	for _, query := range []string{
+		"apply=rotate&angle=abc", "apply=rotate&angle=NaN", "apply=rotate&angle=Inf",
+		"apply=adjustSaturation&percentage=-101", "apply=adjustHue&shift=Inf",
+		"apply=colorBalance&r=-200", "apply=colorBalance&g=x", "apply=channel&c=z",
+	} {
+		mock := server.request("GET", item+"?"+query, "")
+		c.Check(mock.status, Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
+
+func (_ *S) TestRotateMaxPixels(c *C) {
+	defer func(n int) { MaxPixels = n }(MaxPixels)
+	server := newTestServer()
+	item := "/path/rotate/file://" + testdataFile("sample.jpg")
+	server.request("POST", item, "")
+
+	data, _ := ioutil.ReadFile(testdataFile("sample.jpg"))
+	config, _ := checkImage(data)
+	MaxPixels = config.Width * config.Height
+	mock := server.request("GET", item+"?apply=rotate&angle=90", "")
+	c.Check(mock.status, Equals, http.StatusOK)
+	// 45 degrees doubles the area of a square, and more of the others
+	mock = server.request("GET", item+"?apply=rotate&angle=45", "")
+	c.Check(mock.status, Equals, http.StatusRequestEntityTooLarge)
+}
+
+func (_ *S) TestColorOps(c *C) {
+	for _, rgb := range [][3]float64{{1, 0, 0}, {0.2, 0.4, 0.6}, {0.5, 0.5, 0.5}, {0.9, 0.8, 0.1}} {
+		r, g, b := hslToRGB(rgbToHSL(rgb[0], rgb[1], rgb[2]))
+		for i, v := range []float64{r, g, b} {
+			c.Check(math.Abs(v-rgb[i]) < 1e-9, Equals, true, Commentf("%v", rgb))
+		}
+	}
+
+	red := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	red.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	c.Check(adjustHSL(red, 120, 0).At(0, 0), Equals, color.NRGBA{0, 255, 0, 255})
+	c.Check(adjustHSL(red, 0, -100).At(0, 0), Equals, color.NRGBA{128, 128, 128, 255})
+
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	m.Set(0, 0, color.NRGBA{100, 100, 100, 255})
+	m.Set(1, 0, color.NRGBA{110, 110, 110, 255})
+	eq := equalizeImage(m)
+	c.Check(eq.At(0, 0), Equals, color.NRGBA{0, 0, 0, 255})
+	c.Check(eq.At(1, 0), Equals, color.NRGBA{255, 255, 255, 255})
+
+	ch := channelImage(red, "r")
+	c.Check(ch.At(0, 0), Equals, color.Gray{255})
+	ch = channelImage(red, "g")
+	c.Check(ch.At(0, 0), Equals, color.Gray{0})
+}
@@ -10,6 +10,7 @@ package istore
 import "C"
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -68,14 +69,69 @@ type drawRectOptions struct {
 	R, G, B        uint8
 }
 
-func processImage(input io.Reader, mainProc func(image.Image) image.Image) ([]byte, error) {
-	m, format, err := image.Decode(input)
+// AutoOrient applies the EXIF orientation of JPEG before processing, so
+// the output (which doesn't carry EXIF) is displayed in the same way.
+var AutoOrient = true
+
+// orient transforms the image as the EXIF orientation tells.
+func orient(m image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(m)
+	case 3:
+		return imaging.Rotate180(m)
+	case 4:
+		return imaging.FlipV(m)
+	case 5:
+		return imaging.Transpose(m)
+	case 6:
+		return imaging.Rotate270(m)
+	case 7:
+		return imaging.Transverse(m)
+	case 8:
+		return imaging.Rotate90(m)
+	}
+	return m
+}
+
+// exifOrientation returns the EXIF orientation of JPEG, or 1 (normal).
+func exifOrientation(data []byte) int {
+	tiff := jpegExif(data)
+	if tiff == nil {
+		return 1
+	}
+	exif, err := parseExif(tiff)
 	if err != nil {
-		return nil, err
+		glog.Info("failed to parse exif ", err)
+		return 1
+	}
+	if orientation, ok := exif["orientation"].(int64); ok {
+		return int(orientation)
 	}
+	return 1
+}
 
-	m = mainProc(m)
+func decodeImage(input io.Reader, autoOrient bool) (image.Image, string, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, input); err != nil {
+		return nil, "", err
+	}
+	data := buf.Bytes()
+	if _, err := checkImage(data); err != nil {
+		return nil, "", err
+	}
 
+	m, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if autoOrient && format == "jpeg" {
+		m = orient(m, exifOrientation(data))
+	}
+	return m, format, nil
+}
+
+func encodeImage(m image.Image, format string) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	switch format {
 	case "gif":
@@ -92,6 +148,91 @@ func processImage(input io.Reader, mainProc func(image.Image) image.Image) ([]by
 	return buf.Bytes(), nil
 }
 
+// processImage applies mainProc to the image, or to every frame of
+// animated GIF.
+func processImage(input io.Reader, mainProc func(image.Image) image.Image) ([]byte, error) {
+	return processImageSize(input, nil, mainProc)
+}
+
+// processImageSize is processImage of which output size is told by size
+// from the source size, so that the output is limited as well.
+func processImageSize(input io.Reader, size func(image.Point) image.Point, mainProc func(image.Image) image.Image) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, input); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	config, err := checkImage(data)
+	if err != nil {
+		return nil, err
+	}
+	frames := len(gifFrameDelays(data))
+	if err := checkFrames(frames); err != nil {
+		return nil, err
+	}
+	if frames < 1 {
+		frames = 1
+	}
+
+	memory := imageMemory(config.Width, config.Height, frames)
+	if size != nil {
+		src := image.Pt(config.Width, config.Height)
+		if AutoOrient && exifOrientation(data) >= 5 {
+			// transposed
+			src = image.Pt(src.Y, src.X)
+		}
+		out := size(src)
+		if err := checkPixels(out.X, out.Y); err != nil {
+			return nil, err
+		}
+		memory += int64(out.X) * int64(out.Y) * 4 * int64(frames)
+	}
+	release, err := processing.acquire(memory)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if frames > 1 {
+		g, err := gif.DecodeAll(buf)
+		if err != nil {
+			return nil, err
+		}
+		return processGIF(g, mainProc)
+	}
+
+	m, format, err := decodeImage(buf, AutoOrient)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeImage(mainProc(m), format)
+}
+
+// autoOrient applies the EXIF orientation even if AutoOrient is disabled.
+func autoOrient(input io.Reader) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, input); err != nil {
+		return nil, err
+	}
+	if isGIF(buf.Bytes()) {
+		// GIF has no orientation
+		return buf.Bytes(), nil
+	}
+	_, release, err := acquireImage(buf.Bytes(), 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	m, format, err := decodeImage(buf, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeImage(m, format)
+}
+
 func adjustBrightness(input io.Reader, percentage float64) ([]byte, error) {
 	return processImage(input, func(m image.Image) image.Image {
 		return imaging.AdjustBrightness(m, percentage)
@@ -141,9 +282,9 @@ func drawRect(input io.Reader, opts []*drawRectOptions) ([]byte, error) {
 	})
 }
 
-func fit(input io.Reader, width, height int) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Fit(m, width, height, imaging.Lanczos)
+func fit(input io.Reader, opts *resizeOptions) ([]byte, error) {
+	return processImageSize(input, opts.size, func(m image.Image) image.Image {
+		return resizeImage(m, opts)
 	})
 }
 
@@ -189,14 +330,36 @@ func transverse(input io.Reader) ([]byte, error) {
 	})
 }
 
-func resize(input io.Reader, w, h int) ([]byte, error) {
-	return processImage(input, func(m image.Image) image.Image {
-		return imaging.Resize(m, w, h, imaging.Lanczos)
+func resize(input io.Reader, opts *resizeOptions) ([]byte, error) {
+	return processImageSize(input, opts.size, func(m image.Image) image.Image {
+		return resizeImage(m, opts)
 	})
 }
 
 type ExpandArgs struct {
-	Video string `json:"video"`
+	Video string `json:"video,omitempty"`
+	// Image is animated GIF to expand instead of Video.  Only Start, End
+	// and MaxFrames apply to it.
+	Image string `json:"image,omitempty"`
+	// Interval is the seconds between frames (default 1), or Fps is the
+	// number of frames per second.  They can't be given together.
+	Interval float64 `json:"interval,omitempty"`
+	Fps      float64 `json:"fps,omitempty"`
+	// Start and End limit the range in seconds.
+	Start float64 `json:"start,omitempty"`
+	End   float64 `json:"end,omitempty"`
+	// MaxFrames limits the number of frames, if positive.
+	MaxFrames int `json:"max_frames,omitempty"`
+	// Keyframes takes only keyframes.
+	Keyframes bool `json:"keyframes,omitempty"`
+	// Scene takes frames that differ from the previous frame more than this
+	// threshold (0.0 - 1.0), i.e. scene changes.
+	Scene float64 `json:"scene,omitempty"`
+	// Boxes is the metadata field of Image holding bounding boxes.  Each box
+	// is registered as the crop of Image instead of frames.
+	Boxes string `json:"boxes,omitempty"`
+	// Threshold skips the boxes of lower score.
+	Threshold float64 `json:"threshold,omitempty"`
 }
 
 func (s *Server) Expand(w http.ResponseWriter, r *http.Request) {
@@ -213,12 +376,25 @@ func (s *Server) Expand(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unrecognized args", http.StatusBadRequest)
 		return
 	}
-	if args.Video == "" {
-		http.Error(w, "\"video\" field is mandatory", http.StatusBadRequest)
+	if args.Video == "" && args.Image == "" {
+		http.Error(w, "\"video\" or \"image\" field is mandatory", http.StatusBadRequest)
+		return
+	}
+	if args.Boxes != "" && args.Image == "" {
+		http.Error(w, "\"boxes\" requires \"image\"", http.StatusBadRequest)
+		return
+	}
+	if args.Interval < 0 || args.Fps < 0 || args.Start < 0 || args.MaxFrames < 0 ||
+		args.Scene < 0 || args.Scene > 1 || (args.End > 0 && args.End < args.Start) {
+		http.Error(w, "invalid range of args", http.StatusBadRequest)
+		return
+	}
+	if args.Interval > 0 && args.Fps > 0 {
+		http.Error(w, "\"interval\" and \"fps\" are exclusive", http.StatusBadRequest)
 		return
 	}
 
-	videopath := args.Video
+	videopath := args.source()
 	vUrl := extractTargetURL(videopath)
 	if vUrl == "" {
 		msg := fmt.Sprintf("target not found in path %s", videopath)
@@ -226,21 +402,48 @@ func (s *Server) Expand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := s.Client.Get(vUrl)
-	if err != nil {
-		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
+	if isAsync(r) {
+		s.SubmitJob(w, "expand", dir, &args)
 		return
 	}
-	defer resp.Body.Close()
 
-	if err := expand(s, resp.Body, dir, videopath); err != nil {
+	if err := s.expandVideo(dir, &args, nil); err != nil {
 		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
+		http.Error(w, "Error", errorStatus(err, nil))
 		return
 	}
 }
 
+func (args *ExpandArgs) source() string {
+	if args.Video != "" {
+		return args.Video
+	}
+	return args.Image
+}
+
+func (s *Server) expandVideo(dir string, args *ExpandArgs, h *jobHandle) error {
+	objkey := args.source()
+	vUrl := extractTargetURL(objkey)
+	if vUrl == "" {
+		return fmt.Errorf("target not found in path %s", objkey)
+	}
+	if args.Boxes != "" {
+		return s.expandRegions(dir, args, h)
+	}
+
+	resp, err := s.Client.Get(vUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := bufio.NewReader(resp.Body)
+	if magic, _ := body.Peek(4); isGIF(magic) {
+		return expandGIF(s, body, dir, objkey, args, h)
+	}
+	return expand(s, body, dir, objkey, args, h)
+}
+
 func makeInputHandlers(input io.Reader) *gmf.AVIOHandlers {
 	reader, ok := input.(io.ReadSeeker)
 	if !ok {
@@ -273,26 +476,62 @@ func makeInputHandlers(input io.Reader) *gmf.AVIOHandlers {
 	}
 }
 
-func expand(s *Server, input io.Reader, dir, objkey string) error {
-	handlers := makeInputHandlers(input)
+// frameSample is a frame chosen to expand.
+type frameSample struct {
+	Sec      float64
+	Keyframe bool
+	Score    float64
+}
 
-	ctx := gmf.NewCtx()
-	ioctx, err := gmf.NewAVIOContext(ctx, handlers)
-	ctx.SetPb(ioctx)
-	defer ctx.CloseInputAndRelease()
-	defer gmf.Release(ioctx)
+func expand(s *Server, input io.Reader, dir, objkey string, args *ExpandArgs, h *jobHandle) error {
+	d, err := newVideoDecoder(input)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
 
-	if err = ctx.OpenInput("dummy"); err != nil {
+	duration := d.Duration()
+	if args.Keyframes || args.Scene > 0 {
+		// the frames are decoded to choose
+		width, height := d.stream.CodecCtx().Width(), d.stream.CodecCtx().Height()
+		if err := checkPixels(width, height); err != nil {
+			return err
+		}
+		release, err := processing.acquire(imageMemory(width, height, 1))
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	samples, err := sampleFrames(d, args, h)
+	if err != nil {
 		glog.Error(err)
 		return err
 	}
 
+	// We keep the integer seconds format if possible.
+	integral := true
+	for _, sample := range samples {
+		if sample.Sec != math.Floor(sample.Sec) {
+			integral = false
+			break
+		}
+	}
+
 	batch := new(leveldb.Batch)
-	duration := float64(ctx.Duration())
 	// format with padding so path key order agrees with our intension.
-	npads := int(math.Log10(duration/1000000)) + 1
-	snpads := strconv.Itoa(npads)
-	for i := 0; i < int(duration/1000000)+1; i++ {
+	var format string
+	if integral {
+		format = "?apply=frame&sec=%0" + strconv.Itoa(len(strconv.Itoa(int(duration)))) + "d"
+	} else {
+		format = "?apply=frame&ms=%0" + strconv.Itoa(len(strconv.Itoa(int(duration*1000)))) + "d"
+	}
+	for i, sample := range samples {
+		if h.Canceled() {
+			return errJobCanceled
+		}
+		h.SetProgress(0.9 + 0.1*float64(i)/float64(len(samples)))
+
 		// TODO: create relpath.  filepath.Rel() removes duplicate slashes, bad for us.
 		//selfpath, err := filepath.Rel(dir, objkey)
 		//if err != nil {
@@ -303,13 +542,31 @@ func expand(s *Server, input io.Reader, dir, objkey string) error {
 		// Escape only the path part to distinguish it from query string.
 		selfpath := selfURL(objkey)
 		// query string can be raw.
-		selfpath += fmt.Sprintf("?apply=frame&sec=%0"+snpads+"d", i)
+		if integral {
+			selfpath += fmt.Sprintf(format, int(sample.Sec))
+		} else {
+			selfpath += fmt.Sprintf(format, int(math.Floor(sample.Sec*1000+0.5)))
+		}
+		if sample.Keyframe {
+			selfpath += "&keyframe=nearest"
+		}
 
 		key := dir + selfpath
 		meta := map[string]interface{}{}
-		d := time.Duration(i) * time.Second
-		meta["timestamp"] = fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+		d := time.Duration(sample.Sec * float64(time.Second))
+		if integral {
+			meta["timestamp"] = fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+		} else {
+			meta["timestamp"] = fmt.Sprintf("%02d:%02d:%06.3f", int(d.Hours()), int(d.Minutes())%60, math.Mod(d.Seconds(), 60))
+		}
+		meta["sec"] = sample.Sec
 		meta["video"] = objkey
+		if args.Keyframes {
+			meta["keyframe"] = sample.Keyframe
+		}
+		if args.Scene > 0 {
+			meta["scene_score"] = sample.Score
+		}
 		value, _ := json.Marshal(&meta)
 		_, _, err := s.PutObject([]byte(key), string(value), batch, true)
 		if err != nil {
@@ -325,154 +582,219 @@ func expand(s *Server, input io.Reader, dir, objkey string) error {
 	return nil
 }
 
-func frame(input io.Reader, sec int) ([]byte, error) {
-	handlers := makeInputHandlers(input)
-
-	ctx := gmf.NewCtx()
-	defer ctx.CloseInputAndRelease()
-	ioctx, err := gmf.NewAVIOContext(ctx, handlers)
-	if err != nil {
-		return nil, err
+// sampleFrames chooses frames to expand.  Only keyframes and scene changes
+// need to decode the video; otherwise frames are taken at the interval.
+func sampleFrames(d *videoDecoder, args *ExpandArgs, h *jobHandle) ([]frameSample, error) {
+	end := d.Duration()
+	if args.End > 0 && args.End < end {
+		end = args.End
 	}
-	ctx.SetPb(ioctx)
-	defer gmf.Release(ioctx)
-
-	if err = ctx.OpenInput("dummy"); err != nil {
-		glog.Error(err)
-		return nil, err
+	interval := 1.0
+	if args.Fps > 0 {
+		interval = 1 / args.Fps
+	} else if args.Interval > 0 {
+		interval = args.Interval
+	}
+	// more than the frame rate would repeat the same frames
+	if frame := d.FrameDuration(); (args.Fps > 0 || args.Interval > 0) && interval < frame*0.999 {
+		return nil, badRequest("fps %.3f exceeds the frame rate %.3f of the video", 1/interval, 1/frame)
 	}
 
-	srcVideoStream, err := ctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
-	if err != nil {
-		glog.Error(err)
-		return nil, err
+	samples := []frameSample{}
+	full := func() bool {
+		return args.MaxFrames > 0 && len(samples) >= args.MaxFrames
 	}
 
-	if err = ctx.SeekFrameAt(sec, srcVideoStream.Index()); err != nil {
-		glog.Error(err)
-		return nil, err
+	if !args.Keyframes && args.Scene <= 0 {
+		count := math.Floor((end-args.Start)/interval) + 1
+		if args.MaxFrames > 0 && count > float64(args.MaxFrames) {
+			count = float64(args.MaxFrames)
+		}
+		if count > math.MaxInt32 {
+			count = math.MaxInt32
+		}
+		if err := checkExpandFrames(int(count)); err != nil {
+			return nil, err
+		}
+		for i := 0; !full(); i++ {
+			sec := args.Start + float64(i)*interval
+			if sec > end {
+				break
+			}
+			samples = append(samples, frameSample{Sec: sec})
+		}
+		return samples, nil
 	}
 
-	codec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_JPEG2000)
-	if err != nil {
-		glog.Error(err)
-		return nil, err
+	// The interval is the minimum gap between frames only if specified.
+	mingap := 0.0
+	if args.Fps > 0 || args.Interval > 0 {
+		mingap = interval
 	}
+	last := math.Inf(-1)
+	var prev []uint8
 
-	cc := gmf.NewCodecCtx(codec)
-	defer gmf.Release(cc)
+	d.Seek(args.Start)
+	err := d.Decode(func(frame *gmf.Frame) (bool, error) {
+		if h.Canceled() {
+			return false, errJobCanceled
+		}
+		sec := d.Seconds(frame.TimeStamp())
+		if sec < args.Start {
+			return false, nil
+		}
+		if sec > end {
+			return true, nil
+		}
+		if end > args.Start {
+			// decoding takes most of the time
+			h.SetProgress(0.9 * (sec - args.Start) / (end - args.Start))
+		}
 
-	cc.SetPixFmt(gmf.AV_PIX_FMT_RGB24).
-		SetWidth(srcVideoStream.CodecCtx().Width()).
-		SetHeight(srcVideoStream.CodecCtx().Height())
+		keyframe := frame.KeyFrame() != 0
+		if args.Keyframes && !keyframe {
+			return false, nil
+		}
 
-	if codec.IsExperimental() {
-		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
-	}
+		score := 0.0
+		if args.Scene > 0 {
+			thumb := sceneThumbnail(d.Image(frame))
+			if prev != nil {
+				score = frameDifference(prev, thumb)
+			}
+			first := prev == nil
+			prev = thumb
+			if !first && score < args.Scene {
+				return false, nil
+			}
+		}
 
-	if err = cc.Open(nil); err != nil {
-		glog.Error(err)
+		if sec-last < mingap {
+			return false, nil
+		}
+		last = sec
+		samples = append(samples, frameSample{Sec: sec, Keyframe: keyframe, Score: score})
+		if err := checkExpandFrames(len(samples)); err != nil {
+			return false, err
+		}
+
+		return full(), nil
+	})
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	defer cc.Close()
 
-	// Just to surprress "deprected format" warning...
-	cc.SetPixFmt(gmf.AV_PIX_FMT_RGB24)
+	return samples, nil
+}
 
-	// This is necessary to avoid leaking thread used by codec.
-	defer srcVideoStream.CodecCtx().Close()
+// sceneThumbnail returns the luminance of the downscaled image.
+func sceneThumbnail(img image.Image) []uint8 {
+	const size = 64
+	thumb := imaging.Resize(img, size, size, imaging.Box)
+	lum := make([]uint8, size*size)
+	for i := range lum {
+		r, g, b := thumb.Pix[i*4], thumb.Pix[i*4+1], thumb.Pix[i*4+2]
+		lum[i] = uint8((299*int(r) + 587*int(g) + 114*int(b)) / 1000)
+	}
+	return lum
+}
 
-	swsCtx := gmf.NewSwsCtx(srcVideoStream.CodecCtx(), cc, gmf.SWS_POINT)
-	defer gmf.Release(swsCtx)
+// frameDifference returns the mean absolute difference of the two
+// thumbnails, from 0.0 (same) to 1.0.
+func frameDifference(a, b []uint8) float64 {
+	total := 0
+	for i := range a {
+		diff := int(a[i]) - int(b[i])
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	return float64(total) / float64(len(a)) / 255
+}
 
-	dstFrame := gmf.NewFrame().
-		SetWidth(srcVideoStream.CodecCtx().Width()).
-		SetHeight(srcVideoStream.CodecCtx().Height()).
-		SetFormat(gmf.AV_PIX_FMT_RGB24)
-	defer gmf.Release(dstFrame)
+type frameOptions struct {
+	// Sec is the timestamp in seconds.  The nearest frame is returned.
+	Sec float64
+	// N is the frame index, used instead of Sec if >= 0.
+	N int
+	// Keyframe returns the keyframe at or before the timestamp, which doesn't
+	// need to decode other frames.
+	Keyframe bool
+}
 
-	if err := dstFrame.ImgAlloc(); err != nil {
-		glog.Error(err)
-		return nil, err
+// frame returns the JPEG image of the frame and its timestamp in seconds.
+func frame(input io.Reader, opts *frameOptions) ([]byte, float64, error) {
+	d, err := newVideoDecoder(input)
+	if err != nil {
+		return nil, 0, err
 	}
+	defer d.Close()
 
-	for {
-		packet := ctx.GetNextPacket()
-		if packet == nil {
-			break
+	width, height := d.stream.CodecCtx().Width(), d.stream.CodecCtx().Height()
+	if err := checkPixels(width, height); err != nil {
+		return nil, 0, err
+	}
+	release, err := processing.acquire(imageMemory(width, height, 1))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	frameDuration := d.FrameDuration()
+	target := opts.Sec
+	count := false
+	if opts.N >= 0 {
+		if frameDuration > 0 {
+			// assume the constant frame rate
+			target = float64(opts.N) * frameDuration
+		} else {
+			// We don't know the frame rate.  Count from the beginning.
+			count = true
 		}
+	}
+	// the nearest frame is the first one after this
+	threshold := target - 0.0005
+	if frameDuration > 0 {
+		threshold = target - frameDuration/2
+	}
 
-		// Wrap by anonymous func so we can use defer for each iteration.
-		data, err := func(packet *gmf.Packet) ([]byte, error) {
-			defer gmf.Release(packet)
-
-			if packet.StreamIndex() != srcVideoStream.Index() {
-				return nil, nil
-			}
-			ist, err := ctx.GetStream(packet.StreamIndex())
-			if err != nil {
-				return nil, err
-			}
-
-			ready := false
-			var buf *bytes.Buffer
-			for !ready {
-				frame, err := packet.GetNextFrame(ist.CodecCtx())
-				if frame == nil || err != nil {
-					return nil, err
-				}
-
-				if glog.V(5) {
-					glog.Info(fmt.Sprintf("desired = %v, actual = %v", sec, frame.TimeStamp()))
-				}
-				swsCtx.Scale(frame, dstFrame)
-
-				ready = sec*1000 <= frame.TimeStamp()
-
-				if ready {
-					// Encode RGB24 to RGBA to JPEG.
-					// TODO: we could avoid even copy with the loop
-					// by introducing RGB type implementing image.Image
-					streamIndex := 0 // not sure how to determine this??
-					src := dstFrame.Data(streamIndex)
-					img := image.NewRGBA(image.Rect(0, 0, dstFrame.Width(), dstFrame.Height()))
-					stride := img.Stride
-					linesize := dstFrame.LineSize(streamIndex)
-					for y := 0; y < dstFrame.Height(); y++ {
-						for x := 0; x < dstFrame.Width(); x++ {
-							img.Pix[y*stride+x*4+0] = src[y*linesize+x*3+0]
-							img.Pix[y*stride+x*4+1] = src[y*linesize+x*3+1]
-							img.Pix[y*stride+x*4+2] = src[y*linesize+x*3+2]
-							img.Pix[y*stride+x*4+3] = 0
-						}
-					}
-					buf = new(bytes.Buffer)
-					jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
-				}
-
-				gmf.Release(frame)
-
-				if ready {
-					return buf.Bytes(), nil
-				}
-			}
+	if !count {
+		d.Seek(target)
+	}
 
-			return nil, nil
-		}(packet)
+	var data []byte
+	var ts float64
+	index := 0
+	err = d.Decode(func(frame *gmf.Frame) (bool, error) {
+		ts = d.Seconds(frame.TimeStamp())
+		if glog.V(5) {
+			glog.Info(fmt.Sprintf("desired = %v, actual = %v", target, ts))
+		}
 
-		// Error?
-		if err != nil {
-			return nil, err
+		var ready bool
+		switch {
+		case count:
+			ready = index == opts.N
+			index++
+		case opts.Keyframe:
+			ready = true
+		default:
+			ready = threshold <= ts
 		}
-		// Done?
-		if data != nil {
-			return data, nil
+
+		if ready {
+			data = encodeJPEG(d.Image(frame))
 		}
+		return ready, nil
+	})
+
+	if err == io.EOF {
+		// Did we not find frame?
+		return nil, 0, fmt.Errorf("unexpected end of stream")
+	} else if err != nil {
+		return nil, 0, err
 	}
 
-	// Did we not find frame?
-	return nil, fmt.Errorf("unexpected end of stream")
+	return data, ts, nil
 }
-
-// --- snippet
-// curl localhost:8592/path/mp4/slice/ | jq -r '. | sort_by(.metadata.timestamp) | .[] | "\(.metadata.timestamp)<img src=\"http://localhost:8592\(._filepath)\"><br/>"' | sed -e 's/%/%25/g' | sed -e 's/?/%3F/'
@@ -26,4 +26,9 @@ type ItemMeta struct {
 	ItemId   ItemId                 `json:"_id,omitempty" msg:"_id,omitempty"`
 	FilePath string                 `json:"_filepath,omitempty" msg:"_filepath,omitempty"`
 	MetaData map[string]interface{} `json:"metadata,omitempty" msg:"metadata,omitempty"`
+	// Sha256, Size and ContentType describe the object content, recorded
+	// on upload or first fetch.
+	Sha256      string `json:"_sha256,omitempty" msg:"_sha256,omitempty"`
+	Size        int64  `json:"_size,omitempty" msg:"_size,omitempty"`
+	ContentType string `json:"_content_type,omitempty" msg:"_content_type,omitempty"`
 }
@@ -113,6 +113,21 @@ func (z *ItemMeta) DecodeMsg(dc *msgp.Reader) (err error) {
 				}
 				z.MetaData[xvk] = bzg
 			}
+		case "_sha256":
+			z.Sha256, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "_size":
+			z.Size, err = dc.ReadInt64()
+			if err != nil {
+				return
+			}
+		case "_content_type":
+			z.ContentType, err = dc.ReadString()
+			if err != nil {
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -125,7 +140,7 @@ func (z *ItemMeta) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *ItemMeta) EncodeMsg(en *msgp.Writer) (err error) {
-	err = en.WriteMapHeader(3)
+	err = en.WriteMapHeader(6)
 	if err != nil {
 		return
 	}
@@ -163,13 +178,37 @@ func (z *ItemMeta) EncodeMsg(en *msgp.Writer) (err error) {
 			return
 		}
 	}
+	err = en.WriteString("_sha256")
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Sha256)
+	if err != nil {
+		return
+	}
+	err = en.WriteString("_size")
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Size)
+	if err != nil {
+		return
+	}
+	err = en.WriteString("_content_type")
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.ContentType)
+	if err != nil {
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *ItemMeta) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	o = msgp.AppendMapHeader(o, 3)
+	o = msgp.AppendMapHeader(o, 6)
 	o = msgp.AppendString(o, "_id")
 	o = msgp.AppendUint64(o, uint64(z.ItemId))
 	o = msgp.AppendString(o, "_filepath")
@@ -183,6 +222,12 @@ func (z *ItemMeta) MarshalMsg(b []byte) (o []byte, err error) {
 			return
 		}
 	}
+	o = msgp.AppendString(o, "_sha256")
+	o = msgp.AppendString(o, z.Sha256)
+	o = msgp.AppendString(o, "_size")
+	o = msgp.AppendInt64(o, z.Size)
+	o = msgp.AppendString(o, "_content_type")
+	o = msgp.AppendString(o, z.ContentType)
 	return
 }
 
@@ -243,6 +288,21 @@ func (z *ItemMeta) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				}
 				z.MetaData[xvk] = bzg
 			}
+		case "_sha256":
+			z.Sha256, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "_size":
+			z.Size, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				return
+			}
+		case "_content_type":
+			z.ContentType, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -262,5 +322,6 @@ func (z *ItemMeta) Msgsize() (s int) {
 			s += msgp.StringPrefixSize + len(xvk) + msgp.GuessSize(bzg)
 		}
 	}
+	s += msgp.StringPrefixSize + 7 + msgp.StringPrefixSize + len(z.Sha256) + msgp.StringPrefixSize + 5 + msgp.Int64Size + msgp.StringPrefixSize + 13 + msgp.StringPrefixSize + len(z.ContentType)
 	return
 }
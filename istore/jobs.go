@@ -0,0 +1,397 @@
+package istore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const _PathJobNS = "sys.ns.job/"
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// JobWorkers is the number of jobs to run concurrently.
+var JobWorkers = 2
+
+var errJobCanceled = errors.New("job canceled")
+
+// Job is the persistent record of a long-running operation.
+type Job struct {
+	Id       string          `json:"id"`
+	Kind     string          `json:"kind"`
+	Path     string          `json:"path"`
+	Args     json.RawMessage `json:"args,omitempty"`
+	State    string          `json:"state"`
+	Progress float64         `json:"progress"`
+	Error    string          `json:"error,omitempty"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+}
+
+func (job *Job) Key() []byte {
+	return []byte(_PathJobNS + job.Id)
+}
+
+func (job *Job) done() bool {
+	return job.State == JobSucceeded || job.State == JobFailed || job.State == JobCanceled
+}
+
+// jobRunners maps job kinds to the functions to run them.
+var jobRunners = map[string]func(s *Server, job *Job, h *jobHandle) error{
+	"expand": func(s *Server, job *Job, h *jobHandle) error {
+		args := ExpandArgs{}
+		if err := json.Unmarshal(job.Args, &args); err != nil {
+			return err
+		}
+		return s.expandVideo(job.Path, &args, h)
+	},
+	"create_index": func(s *Server, job *Job, h *jobHandle) error {
+		query := Query{}
+		if err := json.Unmarshal(job.Args, &query); err != nil {
+			return err
+		}
+		return s.createIndex(job.Path, &query, h)
+	},
+	"probe": func(s *Server, job *Job, h *jobHandle) error {
+		_, err := s.probeDir(job.Path, h)
+		return err
+	},
+	"warm": func(s *Server, job *Job, h *jobHandle) error {
+		args := WarmArgs{}
+		if err := json.Unmarshal(job.Args, &args); err != nil {
+			return err
+		}
+		_, err := s.warmDir(job.Path, &args, h)
+		return err
+	},
+}
+
+// jobHandle lets the running job report its progress and tells whether it
+// is canceled.  A nil handle is valid for synchronous requests.
+type jobHandle struct {
+	queue    *JobQueue
+	job      *Job
+	canceled chan struct{}
+	saved    time.Time
+}
+
+// SetProgress updates the progress (0.0 - 1.0) of the job.
+func (h *jobHandle) SetProgress(progress float64) {
+	if h == nil {
+		return
+	}
+	h.queue.mu.Lock()
+	h.job.Progress = progress
+	h.queue.mu.Unlock()
+
+	// don't write to db too often
+	if time.Since(h.saved) > time.Second {
+		h.saved = time.Now()
+		h.queue.save(h.job)
+	}
+}
+
+// Canceled returns true if the job is requested to be canceled.
+func (h *jobHandle) Canceled() bool {
+	if h == nil {
+		return false
+	}
+	select {
+	case <-h.canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// JobQueue runs jobs by bounded number of workers.  Jobs are persisted in
+// the db, and unfinished jobs are resumed from the beginning at restart.
+type JobQueue struct {
+	server  *Server
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*Job
+	running map[string]*jobHandle
+}
+
+func NewJobQueue(s *Server, workers int) *JobQueue {
+	q := &JobQueue{
+		server:  s,
+		running: map[string]*jobHandle{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	// resume unfinished jobs
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(_PathJobNS)), nil)
+	for iter.Next() {
+		job := &Job{}
+		if err := json.Unmarshal(iter.Value(), job); err != nil {
+			glog.Error("failed to unmarshal job ", err)
+			continue
+		}
+		if !job.done() {
+			glog.Info("resuming job ", job.Id)
+			job.State = JobQueued
+			job.Progress = 0
+			job.Started = nil
+			q.pending = append(q.pending, job)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		glog.Error(err)
+	}
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+
+	return q
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Submit queues a new job of the kind, with args marshaled to json.
+func (q *JobQueue) Submit(kind, path string, args interface{}) (*Job, error) {
+	if _, ok := jobRunners[kind]; !ok {
+		return nil, fmt.Errorf("unknown job kind %s", kind)
+	}
+	argbytes, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		Id:      newJobId(),
+		Kind:    kind,
+		Path:    path,
+		Args:    argbytes,
+		State:   JobQueued,
+		Created: time.Now(),
+	}
+	if err := q.save(job); err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	q.pending = append(q.pending, job)
+	q.cond.Signal()
+	q.mu.Unlock()
+
+	return job, nil
+}
+
+// Get returns the copy of the job.
+func (q *JobQueue) Get(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if h, ok := q.running[id]; ok {
+		job := *h.job
+		return &job, nil
+	}
+	data, err := q.server.Db.Get([]byte(_PathJobNS+id), nil)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Cancel cancels the queued or running job.
+func (q *JobQueue) Cancel(id string) (*Job, error) {
+	q.mu.Lock()
+	if h, ok := q.running[id]; ok {
+		select {
+		case <-h.canceled:
+		default:
+			close(h.canceled)
+		}
+		job := *h.job
+		q.mu.Unlock()
+		return &job, nil
+	}
+	for i, job := range q.pending {
+		if job.Id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.mu.Unlock()
+			q.finish(job, errJobCanceled)
+			return job, nil
+		}
+	}
+	q.mu.Unlock()
+
+	// already finished, or not found
+	return q.Get(id)
+}
+
+func (q *JobQueue) save(job *Job) error {
+	q.mu.Lock()
+	data, err := json.Marshal(job)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return q.server.Db.Put(job.Key(), data, nil)
+}
+
+func (q *JobQueue) finish(job *Job, err error) {
+	q.mu.Lock()
+	now := time.Now()
+	job.Finished = &now
+	switch err {
+	case nil:
+		job.State = JobSucceeded
+		job.Progress = 1
+	case errJobCanceled:
+		job.State = JobCanceled
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	q.mu.Unlock()
+
+	if err := q.save(job); err != nil {
+		glog.Error(err)
+	}
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		job := q.pending[0]
+		q.pending = q.pending[1:]
+		h := &jobHandle{
+			queue:    q,
+			job:      job,
+			canceled: make(chan struct{}),
+			saved:    time.Now(),
+		}
+		q.running[job.Id] = h
+		now := time.Now()
+		job.State = JobRunning
+		job.Started = &now
+		q.mu.Unlock()
+
+		if err := q.save(job); err != nil {
+			glog.Error(err)
+		}
+
+		glog.Info("running job ", job.Id, " ", job.Kind, " ", job.Path)
+		var err error
+		if run, ok := jobRunners[job.Kind]; ok {
+			err = run(q.server, job, h)
+		} else {
+			// e.g. resumed from the db of another version
+			err = fmt.Errorf("unknown job kind %q", job.Kind)
+		}
+		if err != nil {
+			glog.Error("job ", job.Id, " ", err)
+		}
+
+		q.finish(job, err)
+		q.mu.Lock()
+		delete(q.running, job.Id)
+		q.mu.Unlock()
+	}
+}
+
+// isAsync tells whether the client asks to run the request as a job.
+func isAsync(r *http.Request) bool {
+	switch r.URL.Query().Get("async") {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
+
+// SubmitJob queues the job and responds 202 Accepted with the job.
+func (s *Server) SubmitJob(w http.ResponseWriter, kind, path string, args interface{}) {
+	job, err := s.Jobs.Submit(kind, path, args)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/_jobs/"+job.Id)
+	w.Header()["Content-type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		glog.Error(err)
+	}
+}
+
+// ServeJobs handles GET /_jobs/ (list), GET /_jobs/{id} and
+// DELETE /_jobs/{id} (cancel).
+func (s *Server) ServeJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/_jobs/")
+
+	var result interface{}
+	if id == "" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "job id is required", http.StatusBadRequest)
+			return
+		}
+		jobs := []*Job{}
+		iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(_PathJobNS)), nil)
+		for iter.Next() {
+			job, err := s.Jobs.Get(string(iter.Key()[len(_PathJobNS):]))
+			if err != nil {
+				glog.Error(err)
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+		iter.Release()
+		result = jobs
+	} else {
+		var job *Job
+		var err error
+		if r.Method == "DELETE" {
+			job, err = s.Jobs.Cancel(id)
+		} else {
+			job, err = s.Jobs.Get(id)
+		}
+		if err == leveldb.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			glog.Error(err)
+			http.Error(w, "Error", http.StatusInternalServerError)
+			return
+		}
+		result = job
+	}
+
+	w.Header()["Content-type"] = []string{"application/json"}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package istore
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestJobs(c *C) {
+	server := newTestServer()
+
+	mock := server.request("POST", "/path/empty/_create_index?async=1", `{"similar":{"by":"feature"}}`)
+	c.Assert(mock.status, Equals, http.StatusAccepted)
+	job := Job{}
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &job), IsNil)
+	c.Check(job.Kind, Equals, "create_index")
+	c.Check(job.Path, Equals, "/path/empty/")
+	c.Check(mock.header.Get("Location"), Equals, "/_jobs/"+job.Id)
+
+	// nothing to index, so it fails
+	for i := 0; i < 100 && !job.done(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		mock = server.request("GET", "/_jobs/"+job.Id, "")
+		c.Assert(mock.status, Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(mock.body.Bytes(), &job), IsNil)
+	}
+	c.Check(job.State, Equals, JobFailed)
+	c.Check(job.Error, Equals, errNoIndexItem.Error())
+
+	jobs := []Job{}
+	mock = server.request("GET", "/_jobs/", "")
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &jobs), IsNil)
+	c.Check(len(jobs), Equals, 1)
+
+	// canceling finished job doesn't change it
+	mock = server.request("DELETE", "/_jobs/"+job.Id, "")
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &job), IsNil)
+	c.Check(job.State, Equals, JobFailed)
+
+	mock = server.request("GET", "/_jobs/unknown", "")
+	c.Check(mock.status, Equals, http.StatusNotFound)
+
+	// the job of unknown kind, e.g. resumed from the db of another version
+	unknown := &Job{Id: newJobId(), Kind: "unknown", Path: "/path/empty/", State: JobQueued, Created: time.Now()}
+	c.Assert(server.Jobs.save(unknown), IsNil)
+	server.Jobs.mu.Lock()
+	server.Jobs.pending = append(server.Jobs.pending, unknown)
+	server.Jobs.cond.Signal()
+	server.Jobs.mu.Unlock()
+	job = Job{Id: unknown.Id}
+	for i := 0; i < 100 && !job.done(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		mock = server.request("GET", "/_jobs/"+job.Id, "")
+		c.Assert(json.Unmarshal(mock.body.Bytes(), &job), IsNil)
+	}
+	c.Check(job.State, Equals, JobFailed)
+	c.Check(job.Error, Equals, `unknown job kind "unknown"`)
+}
@@ -0,0 +1,219 @@
+package istore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxPixels limits the size of images to decode, which protects from
+// decompression bombs.  0 for no limit.
+var MaxPixels = 100 * 1000 * 1000
+
+// MaxDimension limits the width and height given by the args of resize,
+// fill, pad etc.  0 for no limit.
+var MaxDimension = 16384
+
+// MaxProcessing is the number of images processed concurrently.  0 for no
+// limit.
+var MaxProcessing = runtime.NumCPU()
+
+// MaxProcessingMemory limits the estimated memory in bytes of the images
+// processed concurrently.  0 for no limit.
+var MaxProcessingMemory int64 = 2 << 30
+
+// ProcessingTimeout is how long a request waits for the others to finish
+// before it's rejected with 503.
+var ProcessingTimeout = 10 * time.Second
+
+// MaxProcessingQueue is the number of requests waiting for the others to
+// finish.  More requests are rejected with 429 at once.  0 for no limit.
+var MaxProcessingQueue = 64
+
+// MaxGIFFrames limits the frames of animated GIF to decode.  0 for no
+// limit.
+var MaxGIFFrames = 1000
+
+// MaxExpandFrames limits the frames registered by one expand of a video.
+// 0 for no limit.
+var MaxExpandFrames = 10000
+
+// statusError is the error responded with its status code.
+type statusError struct {
+	Code    int
+	Message string
+}
+
+func (e *statusError) Error() string {
+	return e.Message
+}
+
+// badRequest is the error of invalid args, responded with 400.
+func badRequest(format string, args ...interface{}) error {
+	return &statusError{Code: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorStatus returns the status code to respond the error of GetApply.
+func errorStatus(err error, resp *http.Response) int {
+	if e, ok := err.(*statusError); ok {
+		return e.Code
+	}
+	if resp != nil {
+		return resp.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// setRetryAfter tells the client to retry after the timeout if the server
+// is busy.
+func setRetryAfter(w http.ResponseWriter, statusCode int) {
+	if statusCode == http.StatusServiceUnavailable || statusCode == http.StatusTooManyRequests {
+		seconds := int(ProcessingTimeout / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
+// checkPixels rejects the image larger than MaxPixels.
+func checkPixels(width, height int) error {
+	if MaxPixels > 0 && int64(width)*int64(height) > int64(MaxPixels) {
+		return &statusError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("image %dx%d exceeds %d pixels", width, height, MaxPixels),
+		}
+	}
+	return nil
+}
+
+// checkFrames rejects animated GIF of more frames than MaxGIFFrames.
+func checkFrames(frames int) error {
+	if MaxGIFFrames > 0 && frames > MaxGIFFrames {
+		return &statusError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("GIF of %d frames exceeds %d", frames, MaxGIFFrames),
+		}
+	}
+	return nil
+}
+
+// checkExpandFrames rejects expand of more frames than MaxExpandFrames.
+func checkExpandFrames(frames int) error {
+	if MaxExpandFrames > 0 && frames > MaxExpandFrames {
+		return badRequest("expand of %d frames exceeds %d", frames, MaxExpandFrames)
+	}
+	return nil
+}
+
+// checkImage reads the header of the image to check the size before
+// decoding it.
+func checkImage(data []byte) (image.Config, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return config, err
+	}
+	return config, checkPixels(config.Width, config.Height)
+}
+
+// imageMemory estimates the memory to process the frames of the size.
+// Each frame is decoded, usually copied to NRGBA by imaging, and the
+// output is another copy, all 4 bytes per pixel.
+func imageMemory(width, height, frames int) int64 {
+	return int64(width) * int64(height) * 4 * 3 * int64(frames)
+}
+
+// processingLimiter bounds the number and the memory of images processed
+// concurrently.
+type processingLimiter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	waiting int
+	memory  int64
+}
+
+func newProcessingLimiter() *processingLimiter {
+	l := &processingLimiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+var processing = newProcessingLimiter()
+
+func (l *processingLimiter) fits(memory int64) bool {
+	if MaxProcessing > 0 && l.running >= MaxProcessing {
+		return false
+	}
+	return MaxProcessingMemory <= 0 || l.memory+memory <= MaxProcessingMemory
+}
+
+// acquire waits for the others until the memory fits, up to
+// ProcessingTimeout.  The returned function releases it.
+func (l *processingLimiter) acquire(memory int64) (func(), error) {
+	if MaxProcessingMemory > 0 && memory > MaxProcessingMemory {
+		return nil, &statusError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("processing needs %d bytes over %d", memory, MaxProcessingMemory),
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.fits(memory) {
+		if MaxProcessingQueue > 0 && l.waiting >= MaxProcessingQueue {
+			return nil, &statusError{
+				Code:    http.StatusTooManyRequests,
+				Message: "too many images waiting for processing",
+			}
+		}
+		l.waiting++
+		defer func() { l.waiting-- }()
+	}
+
+	deadline := time.Now().Add(ProcessingTimeout)
+	timer := time.AfterFunc(ProcessingTimeout, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer timer.Stop()
+	for !l.fits(memory) {
+		if !time.Now().Before(deadline) {
+			return nil, &statusError{
+				Code:    http.StatusServiceUnavailable,
+				Message: "too many images in processing",
+			}
+		}
+		l.cond.Wait()
+	}
+	l.running++
+	l.memory += memory
+
+	return func() {
+		l.mu.Lock()
+		l.running--
+		l.memory -= memory
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	}, nil
+}
+
+// acquireImage checks the size of the image and acquires the memory to
+// decode its frames.
+func acquireImage(data []byte, frames int) (image.Config, func(), error) {
+	config, err := checkImage(data)
+	if err != nil {
+		return config, nil, err
+	}
+	if err := checkFrames(frames); err != nil {
+		return config, nil, err
+	}
+	release, err := processing.acquire(imageMemory(config.Width, config.Height, frames))
+	return config, release, err
+}
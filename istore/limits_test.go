@@ -0,0 +1,84 @@
+package istore
+
+import (
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestProcessingLimiter(c *C) {
+	defer func(n, queue int, memory int64, timeout time.Duration) {
+		MaxProcessing, MaxProcessingQueue, MaxProcessingMemory, ProcessingTimeout = n, queue, memory, timeout
+	}(MaxProcessing, MaxProcessingQueue, MaxProcessingMemory, ProcessingTimeout)
+	MaxProcessing, MaxProcessingMemory, ProcessingTimeout = 1, 100, 10*time.Millisecond
+
+	l := newProcessingLimiter()
+	release, err := l.acquire(60)
+	c.Assert(err, IsNil)
+	_, err = l.acquire(10)
+	c.Check(errorStatus(err, nil), Equals, http.StatusServiceUnavailable)
+
+	// waits for the other
+	ProcessingTimeout = time.Second
+	time.AfterFunc(10*time.Millisecond, release)
+	release, err = l.acquire(10)
+	c.Assert(err, IsNil)
+
+	MaxProcessing, ProcessingTimeout = 0, 10*time.Millisecond
+	release2, err := l.acquire(90)
+	c.Assert(err, IsNil)
+	_, err = l.acquire(1)
+	c.Check(errorStatus(err, nil), Equals, http.StatusServiceUnavailable)
+	release()
+	release2()
+
+	_, err = l.acquire(101)
+	c.Check(errorStatus(err, nil), Equals, http.StatusRequestEntityTooLarge)
+
+	// the queue is full
+	MaxProcessing, MaxProcessingQueue, ProcessingTimeout = 1, 1, time.Second
+	release, err = l.acquire(1)
+	c.Assert(err, IsNil)
+	waited := make(chan error)
+	go func() {
+		release, err := l.acquire(1)
+		if err == nil {
+			release()
+		}
+		waited <- err
+	}()
+	for waiting := 0; waiting == 0; {
+		time.Sleep(time.Millisecond)
+		l.mu.Lock()
+		waiting = l.waiting
+		l.mu.Unlock()
+	}
+	_, err = l.acquire(1)
+	c.Check(errorStatus(err, nil), Equals, http.StatusTooManyRequests)
+	release()
+	c.Check(<-waited, IsNil)
+}
+
+func (_ *S) TestMaxPixels(c *C) {
+	defer func(n int) { MaxPixels = n }(MaxPixels)
+	MaxPixels = 450 * 442
+
+	server := newTestServer()
+	// processed again without the rendition cache
+	server.Renditions = nil
+	testdata := testdataFile("sample.jpg")
+	server.request("POST", "/path/limits/file://"+testdata, "")
+
+	request := func(apply string) *mockWriter {
+		return server.request("GET", "/path/limits/file://"+testdata+"?apply="+apply, "")
+	}
+	c.Check(request("grayscale").status, Equals, http.StatusOK)
+
+	// the output is limited as well
+	c.Check(request("resize&w=451").status, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(request("resize&w=449").status, Equals, http.StatusOK)
+
+	MaxPixels--
+	c.Check(request("grayscale").status, Equals, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,386 @@
+package istore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/glog"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/umitanuki/gmf"
+)
+
+// MaxContactSheetTiles limits the number of tiles in a contact sheet.
+var MaxContactSheetTiles = 400
+
+// MaxContactSheetTileSize limits the width and height of each tile.
+var MaxContactSheetTileSize = 1024
+
+// MaxContactSheetSpacing limits the space between tiles.
+var MaxContactSheetSpacing = 64
+
+var (
+	contactSheetBackground = color.RGBA{32, 32, 32, 255}
+	contactSheetLabelColor = color.RGBA{255, 255, 255, 255}
+)
+
+type contactSheetOptions struct {
+	// N is the number of tiles.
+	N int
+	// Cols is the number of columns.  0 makes the grid close to square.
+	Cols int
+	// Width and Height are the size of each tile.  Height 0 follows the
+	// aspect ratio of the first image.
+	Width, Height int
+	// Spacing is the space between tiles and around the sheet.
+	Spacing int
+	// Label is "timestamp", "path" or "" for no label.
+	Label string
+}
+
+type contactTile struct {
+	// Image may be nil if the item could not be decoded.
+	Image image.Image
+	Label string
+}
+
+func parseContactSheetOptions(r *http.Request) (*contactSheetOptions, error) {
+	opts := &contactSheetOptions{N: 16, Width: 160, Spacing: 4}
+	intValue := func(name string, value *int) error {
+		if v := r.FormValue(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return badRequest("invalid %s %q", name, v)
+			}
+			*value = n
+		}
+		return nil
+	}
+	for name, value := range map[string]*int{
+		"n": &opts.N, "cols": &opts.Cols, "w": &opts.Width, "h": &opts.Height, "spacing": &opts.Spacing,
+	} {
+		if err := intValue(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if opts.N == 0 || opts.N > MaxContactSheetTiles || opts.Width == 0 ||
+		opts.Width > MaxContactSheetTileSize || opts.Height > MaxContactSheetTileSize ||
+		opts.Spacing > MaxContactSheetSpacing {
+		return nil, badRequest("invalid range of args for contactsheet")
+	}
+
+	switch label := r.FormValue("label"); label {
+	case "", "timestamp", "path":
+		opts.Label = label
+	default:
+		return nil, badRequest("unknown label %q", label)
+	}
+	return opts, nil
+}
+
+// contactSheetGrid returns the number of columns and rows for n tiles.
+func contactSheetGrid(n, cols int) (int, int) {
+	if cols <= 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(n))))
+	}
+	if cols > n {
+		cols = n
+	}
+	return cols, (n + cols - 1) / cols
+}
+
+func formatTimestamp(sec float64) string {
+	d := time.Duration(sec * float64(time.Second))
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// contactSheetLayout is the size of the tiles and the grid.
+type contactSheetLayout struct {
+	Width, Height int
+	LabelHeight   int
+	// Scale is the scale of the label font.
+	Scale      int
+	Cols, Rows int
+}
+
+// newContactSheetLayout lays out n tiles.  The tile height follows the
+// aspect ratio of first, the size of the first image, if not given.
+func newContactSheetLayout(n int, first image.Point, opts *contactSheetOptions) *contactSheetLayout {
+	l := &contactSheetLayout{Width: opts.Width, Height: opts.Height, Scale: 1}
+	if l.Height == 0 {
+		l.Height = l.Width * 3 / 4
+		if first.X > 0 && first.Y > 0 {
+			l.Height = int(float64(l.Width)*float64(first.Y)/float64(first.X) + 0.5)
+		}
+	}
+	if l.Width >= 320 {
+		l.Scale = 2
+	}
+	if opts.Label != "" {
+		l.LabelHeight = (glyphHeight + 4) * l.Scale
+	}
+	l.Cols, l.Rows = contactSheetGrid(n, opts.Cols)
+	return l
+}
+
+// Size returns the size of the sheet.
+func (l *contactSheetLayout) Size(spacing int) image.Point {
+	cellWidth, cellHeight := l.Width+spacing, l.Height+l.LabelHeight+spacing
+	return image.Pt(l.Cols*cellWidth+spacing, l.Rows*cellHeight+spacing)
+}
+
+// acquireContactSheet checks the size of the sheet and acquires the memory
+// for it and the tiles.
+func acquireContactSheet(l *contactSheetLayout, opts *contactSheetOptions, extra int64) (func(), error) {
+	size := l.Size(opts.Spacing)
+	if err := checkPixels(size.X, size.Y); err != nil {
+		return nil, err
+	}
+	return processing.acquire(imageMemory(size.X, size.Y, 1) + extra)
+}
+
+// fitTile shrinks m to the tile width, and the height if given, so that
+// the tiles don't keep the large images until they are rendered.
+func fitTile(m image.Image, opts *contactSheetOptions) image.Image {
+	b := m.Bounds()
+	height := opts.Height
+	if height == 0 {
+		height = b.Dy()
+	}
+	if b.Dx() <= opts.Width && b.Dy() <= height {
+		return m
+	}
+	return imaging.Fit(m, opts.Width, height, imaging.Linear)
+}
+
+// tilesLayout lays out the tiles by the first image.
+func tilesLayout(tiles []contactTile, opts *contactSheetOptions) *contactSheetLayout {
+	first := image.ZP
+	for _, tile := range tiles {
+		if tile.Image != nil {
+			first = tile.Image.Bounds().Size()
+			break
+		}
+	}
+	return newContactSheetLayout(len(tiles), first, opts)
+}
+
+// renderContactSheet lays out the tiles in the grid, each image fit in the
+// tile and centered, with the label below it.
+func renderContactSheet(tiles []contactTile, opts *contactSheetOptions) *image.RGBA {
+	l := tilesLayout(tiles, opts)
+	width, height, labelHeight, scale, cols := l.Width, l.Height, l.LabelHeight, l.Scale, l.Cols
+
+	cellWidth, cellHeight := width+opts.Spacing, height+labelHeight+opts.Spacing
+	size := l.Size(opts.Spacing)
+	sheet := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactSheetBackground), image.ZP, draw.Src)
+
+	for i, tile := range tiles {
+		origin := image.Pt(opts.Spacing+(i%cols)*cellWidth, opts.Spacing+(i/cols)*cellHeight)
+		if tile.Image != nil {
+			m := imaging.Fit(tile.Image, width, height, imaging.Linear)
+			b := m.Bounds()
+			pt := origin.Add(image.Pt((width-b.Dx())/2, (height-b.Dy())/2))
+			draw.Draw(sheet, b.Sub(b.Min).Add(pt), m, b.Min, draw.Over)
+		}
+		if labelHeight > 0 && tile.Label != "" {
+			text := fitText(tile.Label, width, scale)
+			size := textSize(text, scale)
+			pt := origin.Add(image.Pt((width-size.X)/2, height+2*scale))
+			drawText(sheet, pt, text, scale, contactSheetLabelColor)
+		}
+	}
+	return sheet
+}
+
+// videoContactSheet samples N frames evenly over the duration of the video.
+func videoContactSheet(input io.Reader, opts *contactSheetOptions) ([]byte, error) {
+	d, err := newVideoDecoder(input)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	duration := d.Duration()
+	if duration <= 0 {
+		return nil, fmt.Errorf("unknown duration of video")
+	}
+	frameDuration := d.FrameDuration()
+
+	width, height := d.stream.CodecCtx().Width(), d.stream.CodecCtx().Height()
+	if err := checkPixels(width, height); err != nil {
+		return nil, err
+	}
+	// the decoded frame, and the tiles as large as the sheet
+	release, err := acquireContactSheet(newContactSheetLayout(opts.N, image.Pt(width, height), opts), opts,
+		imageMemory(width, height, 1))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	tiles := []contactTile{}
+	for i := 0; i < opts.N; i++ {
+		target := duration * float64(i) / float64(opts.N)
+		// the nearest frame is the first one after this
+		threshold := target - 0.0005
+		if frameDuration > 0 {
+			threshold = target - frameDuration/2
+		}
+
+		d.Seek(target)
+		tile := contactTile{}
+		err := d.Decode(func(frame *gmf.Frame) (bool, error) {
+			ts := d.Seconds(frame.TimeStamp())
+			if ts < threshold {
+				return false, nil
+			}
+			tile.Image = fitTile(d.Image(frame), opts)
+			if opts.Label != "" {
+				tile.Label = formatTimestamp(ts)
+			}
+			return true, nil
+		})
+		if err == io.EOF {
+			// the duration may be longer than the video stream
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tiles = append(tiles, tile)
+	}
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("no frame found")
+	}
+
+	return encodeJPEG(renderContactSheet(tiles, opts)), nil
+}
+
+// fetchTileImage decodes the object of the item, or the first frame if it
+// is a video, fit in the tile.
+func (s *Server) fetchTileImage(Url string, opts *contactSheetOptions) (image.Image, error) {
+	resp, err := s.Client.Get(Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", Url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		// not an image, so the first frame of the video
+		if data, _, err = frame(bytes.NewReader(data), &frameOptions{N: -1}); err != nil {
+			return nil, err
+		}
+	}
+	_, release, err := acquireImage(data, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	m, _, err := decodeImage(bytes.NewReader(data), AutoOrient)
+	if err != nil {
+		return nil, err
+	}
+	return fitTile(m, opts), nil
+}
+
+// itemLabel returns the label of the item under dir.
+func itemLabel(dir, key string, meta *ItemMeta, label string) string {
+	switch label {
+	case "path":
+		return key[len(dir):]
+	case "timestamp":
+		if ts, ok := meta.MetaData["timestamp"].(string); ok {
+			return ts
+		}
+		if sec, ok := meta.MetaData["sec"].(float64); ok {
+			return formatTimestamp(sec)
+		}
+	}
+	return ""
+}
+
+// dirContactSheet renders the first N items under the directory.
+func (s *Server) dirContactSheet(dir string, opts *contactSheetOptions) ([]byte, error) {
+	tiles := []contactTile{}
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() && len(tiles) < opts.N {
+		key := string(iter.Key())
+		Url := extractTargetURL(key)
+		if Url == "" {
+			continue
+		}
+		meta := ItemMeta{}
+		if _, err := meta.UnmarshalMsg(iter.Value()); err != nil {
+			glog.Error("failed to unmarshal metadata from db ", err)
+		}
+
+		tile := contactTile{Label: itemLabel(dir, key, &meta, opts.Label)}
+		m, err := s.fetchTileImage(Url, opts)
+		if err != nil {
+			// leave the tile blank so the others are still visible
+			glog.Error(err)
+		} else {
+			tile.Image = m
+		}
+		tiles = append(tiles, tile)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(tiles) == 0 {
+		return nil, nil
+	}
+
+	// the tiles are fit, so as large as the sheet
+	release, err := acquireContactSheet(tilesLayout(tiles, opts), opts, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return encodeJPEG(renderContactSheet(tiles, opts)), nil
+}
+
+// ServeContactSheet renders the items under the directory in a grid.
+func (s *Server) ServeContactSheet(w http.ResponseWriter, r *http.Request, dir string) {
+	opts, err := parseContactSheetOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := s.dirContactSheet(dir, opts)
+	if err != nil {
+		statusCode := errorStatus(err, nil)
+		glog.Error(err, statusCode)
+		setRetryAfter(w, statusCode)
+		http.Error(w, "Error", statusCode)
+		return
+	}
+	if img == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.Write(img)
+}
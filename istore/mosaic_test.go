@@ -0,0 +1,63 @@
+package istore
+
+import (
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestRenderContactSheet(c *C) {
+	cols, rows := contactSheetGrid(10, 0)
+	c.Check([]int{cols, rows}, DeepEquals, []int{4, 3})
+	cols, rows = contactSheetGrid(2, 5)
+	c.Check([]int{cols, rows}, DeepEquals, []int{2, 1})
+
+	c.Check(fitText("/path/to/frame.jpg", 6*10-1, 1), Equals, "..rame.jpg")
+	c.Check(textSize("00:01", 2), Equals, image.Pt(58, 14))
+
+	tiles := []contactTile{
+		{Image: image.NewRGBA(image.Rect(0, 0, 40, 20)), Label: "00:00:01"},
+		{Label: "broken"},
+		{Image: image.NewGray(image.Rect(0, 0, 20, 20))},
+	}
+	opts := &contactSheetOptions{Cols: 2, Width: 80, Spacing: 4, Label: "timestamp"}
+	sheet := renderContactSheet(tiles, opts)
+	// 2x2 tiles of 80x40 with labels of 11 pixels
+	c.Check(sheet.Bounds(), Equals, image.Rect(0, 0, 4+2*84, 4+2*(40+11+4)))
+	// the label is drawn below the first tile
+	found := false
+	for x := 4; x < 84; x++ {
+		if r, _, _, _ := sheet.At(x, 4+40+2+3).RGBA(); r == 0xffff {
+			found = true
+		}
+	}
+	c.Check(found, Equals, true)
+}
+
+func (_ *S) TestDirContactSheet(c *C) {
+	server := newTestServer()
+	imgfile := testdataFile("sample.jpg")
+
+	for _, item := range []string{"a", "b", "c"} {
+		server.request("POST", "/path/sheet/"+item+"/file://"+imgfile, "")
+	}
+	mock := server.request("GET", "/path/sheet/?apply=contactsheet&n=2&w=50&h=50&spacing=0&label=path", "")
+	c.Check(strings.HasPrefix(mock.body.String(), "\xff\xd8"), Equals, true)
+	m, err := jpeg.Decode(&mock.body)
+	c.Assert(err, IsNil)
+	c.Check(m.Bounds(), Equals, image.Rect(0, 0, 100, 50+11))
+
+	mock = server.request("GET", "/path/sheet/?apply=contactsheet&label=size", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("GET", "/path/sheet/?apply=contactsheet&w=100000", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("GET", "/path/sheet/?apply=contactsheet&spacing=100000", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("GET", "/path/sheet/a/file://"+imgfile+"?apply=contactsheet&h=100000", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("GET", "/path/nothing/?apply=contactsheet", "")
+	c.Check(mock.status, Equals, http.StatusNotFound)
+}
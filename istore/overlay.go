@@ -0,0 +1,335 @@
+package istore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// overlayShape is an element of the overlay drawn by apply=overlay, e.g.
+//
+//	[{"type": "box", "x1": 10, "y1": 20, "x2": 110, "y2": 220, "color": "#00ff00",
+//	  "width": 3, "fill": 0.2, "label": "person 0.92"},
+//	 {"type": "keypoints", "points": [[50, 40], [60, 80, 0]], "edges": [[0, 1]]}]
+type overlayShape struct {
+	// Type is one of box, polygon, polyline, circle and keypoints.
+	Type string `json:"type"`
+	// box
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+	X2 float64 `json:"x2"`
+	Y2 float64 `json:"y2"`
+	// circle
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	R float64 `json:"r"`
+	// Points are [x, y] of polygon, polyline and keypoints.  Keypoints may
+	// have the third value of visibility, and 0 means not visible.
+	Points [][]float64 `json:"points"`
+	// Edges are pairs of keypoint indices to connect.
+	Edges [][2]int `json:"edges"`
+	// Radius is the radius of keypoints.
+	Radius float64 `json:"radius"`
+
+	// Color is #rgb, #rrggbb or #rrggbbaa.  Red by default.
+	Color string `json:"color"`
+	// Width is the line width, 2 by default.
+	Width float64 `json:"width"`
+	// Fill is the opacity (0.0 - 1.0) to fill the shape with its color.
+	Fill float64 `json:"fill"`
+	// Label is drawn in ASCII at the top-left of the shape.
+	Label string `json:"label"`
+	// Scale is the magnification of the label font, 2 by default.
+	Scale int `json:"scale"`
+
+	col color.NRGBA
+}
+
+// parseColor parses #rgb, #rrggbb or #rrggbbaa.
+func parseColor(s string) (color.NRGBA, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != 4 {
+		return color.NRGBA{}, badRequest("invalid color %q", s)
+	}
+	return color.NRGBA{b[0], b[1], b[2], b[3]}, nil
+}
+
+func parseOverlay(s string) ([]*overlayShape, error) {
+	shapes := []*overlayShape{}
+	if err := json.Unmarshal([]byte(s), &shapes); err != nil {
+		return nil, badRequest("invalid overlay: %v", err)
+	}
+	for _, shape := range shapes {
+		switch shape.Type {
+		case "box", "circle":
+		case "polygon", "polyline", "keypoints":
+			for _, p := range shape.Points {
+				if len(p) < 2 {
+					return nil, badRequest("invalid point %v in %s", p, shape.Type)
+				}
+			}
+			for _, e := range shape.Edges {
+				if e[0] < 0 || e[0] >= len(shape.Points) || e[1] < 0 || e[1] >= len(shape.Points) {
+					return nil, badRequest("invalid edge %v in %s", e, shape.Type)
+				}
+			}
+		default:
+			return nil, badRequest("unknown overlay type %q", shape.Type)
+		}
+
+		shape.col = color.NRGBA{255, 0, 0, 255}
+		if shape.Color != "" {
+			col, err := parseColor(shape.Color)
+			if err != nil {
+				return nil, err
+			}
+			shape.col = col
+		}
+		if shape.Width <= 0 {
+			shape.Width = 2
+		}
+		if shape.Radius <= 0 {
+			shape.Radius = shape.Width + 1
+		}
+		if shape.Scale <= 0 {
+			shape.Scale = 2
+		}
+		if shape.Fill < 0 || shape.Fill > 1 {
+			return nil, badRequest("fill should be in 0.0 - 1.0: %v", shape.Fill)
+		}
+	}
+	return shapes, nil
+}
+
+// fillSpan blends the color over the pixels [x1, x2) in the row y.
+func fillSpan(dst draw.Image, x1, x2, y int, src image.Image) {
+	draw.Draw(dst, image.Rect(x1, y, x2, y+1), src, image.ZP, draw.Over)
+}
+
+// fillPolygon fills the polygon by the even-odd rule, sampling at the
+// center of pixels.
+func fillPolygon(dst draw.Image, points [][2]float64, c color.Color) {
+	if len(points) < 3 {
+		return
+	}
+	src := image.NewUniform(c)
+	minY, maxY := points[0][1], points[0][1]
+	for _, p := range points {
+		minY, maxY = math.Min(minY, p[1]), math.Max(maxY, p[1])
+	}
+	b := dst.Bounds()
+	y1 := int(math.Max(math.Floor(minY), float64(b.Min.Y)))
+	y2 := int(math.Min(math.Ceil(maxY), float64(b.Max.Y)))
+
+	xs := []float64{}
+	for y := y1; y < y2; y++ {
+		cy := float64(y) + 0.5
+		xs = xs[:0]
+		for i, p := range points {
+			q := points[(i+1)%len(points)]
+			if (p[1] <= cy) != (q[1] <= cy) {
+				xs = append(xs, p[0]+(cy-p[1])*(q[0]-p[0])/(q[1]-p[1]))
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			// pixels whose center is inside
+			fillSpan(dst, int(math.Ceil(xs[i]-0.5)), int(math.Ceil(xs[i+1]-0.5)), y, src)
+		}
+	}
+}
+
+// fillRing fills between the circles of radius inner and outer.  inner 0
+// fills the disc.
+func fillRing(dst draw.Image, cx, cy, outer, inner float64, c color.Color) {
+	src := image.NewUniform(c)
+	b := dst.Bounds()
+	y1 := int(math.Max(math.Floor(cy-outer), float64(b.Min.Y)))
+	y2 := int(math.Min(math.Ceil(cy+outer), float64(b.Max.Y)))
+	for y := y1; y < y2; y++ {
+		dy := float64(y) + 0.5 - cy
+		if dy*dy > outer*outer {
+			continue
+		}
+		ox := math.Sqrt(outer*outer - dy*dy)
+		left, right := int(math.Ceil(cx-ox-0.5)), int(math.Ceil(cx+ox-0.5))
+		if inner > 0 && dy*dy < inner*inner {
+			ix := math.Sqrt(inner*inner - dy*dy)
+			fillSpan(dst, left, int(math.Ceil(cx-ix-0.5)), y, src)
+			fillSpan(dst, int(math.Ceil(cx+ix-0.5)), right, y, src)
+		} else {
+			fillSpan(dst, left, right, y, src)
+		}
+	}
+}
+
+// strokeLine draws the segment of the width with round caps.
+func strokeLine(dst draw.Image, p, q [2]float64, width float64, c color.Color) {
+	half := width / 2
+	dx, dy := q[0]-p[0], q[1]-p[1]
+	length := math.Hypot(dx, dy)
+	if length > 0 {
+		// normal vector
+		nx, ny := -dy/length*half, dx/length*half
+		fillPolygon(dst, [][2]float64{
+			{p[0] + nx, p[1] + ny}, {q[0] + nx, q[1] + ny},
+			{q[0] - nx, q[1] - ny}, {p[0] - nx, p[1] - ny},
+		}, c)
+	}
+	if width > 2 {
+		fillRing(dst, p[0], p[1], half, 0, c)
+		fillRing(dst, q[0], q[1], half, 0, c)
+	}
+}
+
+// drawLabel draws the text on the background of the color, above pt if
+// there is room, otherwise below.
+func drawLabel(dst draw.Image, pt image.Point, text string, scale int, c color.NRGBA) {
+	size := textSize(text, scale)
+	pad := scale
+	box := image.Rect(0, 0, size.X+2*pad, size.Y+2*pad).Add(pt)
+	if top := box.Sub(image.Pt(0, box.Dy())); top.Min.Y >= dst.Bounds().Min.Y {
+		box = top
+	}
+	draw.Draw(dst, box, image.NewUniform(color.NRGBA{c.R, c.G, c.B, 255}), image.ZP, draw.Over)
+
+	// black text on the light background
+	textColor := color.Color(color.White)
+	if 299*int(c.R)+587*int(c.G)+114*int(c.B) > 128*1000 {
+		textColor = color.Black
+	}
+	drawText(dst, box.Min.Add(image.Pt(pad, pad)), text, scale, textColor)
+}
+
+func (shape *overlayShape) points() [][2]float64 {
+	points := make([][2]float64, len(shape.Points))
+	for i, p := range shape.Points {
+		points[i] = [2]float64{p[0], p[1]}
+	}
+	return points
+}
+
+func (shape *overlayShape) draw(dst draw.Image) {
+	c := shape.col
+	fill := c
+	fill.A = uint8(float64(c.A)*shape.Fill + 0.5)
+	var labelAt image.Point
+
+	switch shape.Type {
+	case "box":
+		x1, x2 := math.Min(shape.X1, shape.X2), math.Max(shape.X1, shape.X2)
+		y1, y2 := math.Min(shape.Y1, shape.Y2), math.Max(shape.Y1, shape.Y2)
+		if fill.A > 0 {
+			fillPolygon(dst, [][2]float64{{x1, y1}, {x2, y1}, {x2, y2}, {x1, y2}}, fill)
+		}
+		// the line is inside of the box
+		w := math.Min(shape.Width, math.Min(x2-x1, y2-y1)/2)
+		for _, r := range [][4]float64{
+			{x1, y1, x2, y1 + w}, {x1, y2 - w, x2, y2},
+			{x1, y1 + w, x1 + w, y2 - w}, {x2 - w, y1 + w, x2, y2 - w},
+		} {
+			fillPolygon(dst, [][2]float64{{r[0], r[1]}, {r[2], r[1]}, {r[2], r[3]}, {r[0], r[3]}}, c)
+		}
+		labelAt = image.Pt(int(x1), int(y1))
+
+	case "circle":
+		if fill.A > 0 {
+			fillRing(dst, shape.X, shape.Y, shape.R, 0, fill)
+		}
+		fillRing(dst, shape.X, shape.Y, shape.R+shape.Width/2, math.Max(shape.R-shape.Width/2, 0), c)
+		labelAt = image.Pt(int(shape.X-shape.R), int(shape.Y-shape.R))
+
+	case "polygon", "polyline":
+		points := shape.points()
+		if len(points) == 0 {
+			return
+		}
+		if shape.Type == "polygon" && fill.A > 0 {
+			fillPolygon(dst, points, fill)
+		}
+		for i := 0; i+1 < len(points); i++ {
+			strokeLine(dst, points[i], points[i+1], shape.Width, c)
+		}
+		if shape.Type == "polygon" {
+			strokeLine(dst, points[len(points)-1], points[0], shape.Width, c)
+		}
+		labelAt = image.Pt(int(points[0][0]), int(points[0][1]))
+
+	case "keypoints":
+		visible := func(i int) bool {
+			p := shape.Points[i]
+			return len(p) < 3 || p[2] != 0
+		}
+		points := shape.points()
+		for _, e := range shape.Edges {
+			if visible(e[0]) && visible(e[1]) {
+				strokeLine(dst, points[e[0]], points[e[1]], shape.Width, c)
+			}
+		}
+		labelAt = image.Pt(math.MaxInt32, math.MaxInt32)
+		for i, p := range points {
+			if visible(i) {
+				fillRing(dst, p[0], p[1], shape.Radius, 0, c)
+				if p[1] < float64(labelAt.Y) {
+					labelAt = image.Pt(int(p[0]), int(p[1]-shape.Radius))
+				}
+			}
+		}
+		if labelAt.Y == math.MaxInt32 {
+			return
+		}
+	}
+
+	if shape.Label != "" {
+		drawLabel(dst, labelAt, shape.Label, shape.Scale, c)
+	}
+}
+
+func overlay(input io.Reader, shapes []*overlayShape) ([]byte, error) {
+	return processImage(input, func(m image.Image) image.Image {
+		r := m.Bounds()
+		m2 := image.NewRGBA(r)
+		draw.Draw(m2, r, m, r.Min, draw.Src)
+		for _, shape := range shapes {
+			shape.draw(m2)
+		}
+		return m2
+	})
+}
+
+// PostApply serves the processed object like GET, taking the parameter
+// from the body, which may be too long for the query string.
+func (s *Server) PostApply(w http.ResponseWriter, r *http.Request, param string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	if len(body) > 0 {
+		// Put it to the query so that Etag reflects it.
+		query := r.URL.Query()
+		query.Set(param, string(body))
+		r.URL.RawQuery = query.Encode()
+		r.Form = nil
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(""))
+	s.ServeGet(w, r)
+}
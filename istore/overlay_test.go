@@ -0,0 +1,69 @@
+package istore
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestParseOverlay(c *C) {
+	col, err := parseColor("#0f8")
+	c.Assert(err, IsNil)
+	c.Check(col, Equals, color.NRGBA{0, 0xff, 0x88, 0xff})
+	col, err = parseColor("#11223380")
+	c.Assert(err, IsNil)
+	c.Check(col, Equals, color.NRGBA{0x11, 0x22, 0x33, 0x80})
+	_, err = parseColor("red")
+	c.Check(err, NotNil)
+
+	shapes, err := parseOverlay(`[{"type": "box", "x2": 10, "y2": 10}]`)
+	c.Assert(err, IsNil)
+	c.Check(shapes[0].Width, Equals, 2.0)
+	c.Check(shapes[0].col, Equals, color.NRGBA{255, 0, 0, 255})
+
+	server := newTestServer()
+	item := "/path/overlay/file://" + testdataFile("sample.jpg")
+	server.request("POST", item, "")
+	for _, s := range []string{
+		`{"type": "box"}`,
+		`[{"type": "star"}]`,
+		`[{"type": "polygon", "points": [[1]]}]`,
+		`[{"type": "keypoints", "points": [[1, 2]], "edges": [[0, 1]]}]`,
+		`[{"type": "box", "color": "red"}]`,
+		`[{"type": "box", "fill": 2}]`,
+	} {
+		mock := server.request("GET", item+"?apply=overlay&overlay="+url.QueryEscape(s), "")
+		c.Check(mock.status, Equals, http.StatusBadRequest, Commentf("%s", s))
+	}
+}
+
+func (_ *S) TestDrawOverlay(c *C) {
+	m := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	shapes, err := parseOverlay(`[
+		{"type": "box", "x1": 10, "y1": 30, "x2": 50, "y2": 70, "width": 3, "fill": 0.5, "color": "#00f", "label": "a"},
+		{"type": "circle", "x": 80, "y": 80, "r": 10, "width": 2},
+		{"type": "keypoints", "points": [[70, 10], [90, 10], [90, 30, 0]], "edges": [[0, 1], [1, 2]], "color": "#0f0"}
+	]`)
+	c.Assert(err, IsNil)
+	for _, shape := range shapes {
+		shape.draw(m)
+	}
+
+	c.Check(m.At(10, 50), Equals, color.RGBA{0, 0, 255, 255})     // line
+	c.Check(m.At(12, 50), Equals, color.RGBA{0, 0, 255, 255})     // 3 pixels wide
+	c.Check(m.At(13, 50), Equals, color.RGBA{127, 127, 255, 255}) // filled half
+	c.Check(m.At(5, 5), Equals, color.RGBA{255, 255, 255, 255})
+	// the label is above the box
+	c.Check(m.At(10, 29), Equals, color.RGBA{0, 0, 255, 255})
+
+	c.Check(m.At(90, 80), Equals, color.RGBA{255, 0, 0, 255})     // circle
+	c.Check(m.At(80, 80), Equals, color.RGBA{255, 255, 255, 255}) // not filled
+
+	c.Check(m.At(80, 10), Equals, color.RGBA{0, 255, 0, 255})     // edge
+	c.Check(m.At(90, 20), Equals, color.RGBA{255, 255, 255, 255}) // to invisible point
+}
@@ -0,0 +1,202 @@
+package istore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/umitanuki/gmf"
+)
+
+// MaxPreviewFrames limits the number of frames in a preview.
+var MaxPreviewFrames = 300
+
+// MaxPreviewWidth limits the width of a preview.
+var MaxPreviewWidth = 1280
+
+type previewOptions struct {
+	// Start is the beginning of the preview in seconds.
+	Start float64
+	// Duration is the length of the preview in seconds.
+	Duration float64
+	// FPS is the frame rate of the preview.
+	FPS float64
+	// Width is the width of the preview, up to the width of the video.
+	// The aspect ratio is kept.
+	Width int
+	// Format is "gif" or "mjpeg".
+	Format string
+}
+
+// parsePreviewOptions parses the args of preview, bounding the frames
+// before the video is decoded.
+func parsePreviewOptions(r *http.Request) (*previewOptions, error) {
+	opts := &previewOptions{
+		Duration: 3,
+		FPS:      10,
+		Width:    320,
+		Format:   r.FormValue("format"),
+	}
+	for name, value := range map[string]*float64{
+		"start": &opts.Start, "duration": &opts.Duration, "fps": &opts.FPS,
+	} {
+		if v := r.FormValue(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, badRequest("invalid %s %q", name, v)
+			}
+			*value = f
+		}
+	}
+	if v := r.FormValue("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, badRequest("invalid w %q", v)
+		}
+		opts.Width = n
+	}
+	// written to fail with NaN
+	if !(opts.Start >= 0) || math.IsInf(opts.Start, 1) || !(opts.Duration > 0) || !(opts.FPS > 0) ||
+		opts.Width <= 0 || opts.Width > MaxPreviewWidth {
+		return nil, badRequest("invalid range of args for preview")
+	}
+	if count := math.Ceil(opts.Duration * opts.FPS); !(count <= float64(MaxPreviewFrames)) {
+		return nil, badRequest("too many frames in preview: %v", count)
+	}
+	return opts, nil
+}
+
+// previewFrames decodes frames of the video at the rate of opts.FPS,
+// resized to opts.Width.  It returns the images and their timestamps.
+func previewFrames(input io.Reader, opts *previewOptions) ([]image.Image, []float64, error) {
+	d, err := newVideoDecoder(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer d.Close()
+
+	count := int(math.Ceil(opts.Duration * opts.FPS))
+
+	width, height := d.stream.CodecCtx().Width(), d.stream.CodecCtx().Height()
+	if err := checkPixels(width, height); err != nil {
+		return nil, nil, err
+	}
+	outWidth, outHeight := opts.Width, 1
+	if width > 0 {
+		// never enlarged
+		outWidth = minInt(outWidth, width)
+		outHeight = maxInt(int(float64(height)*float64(outWidth)/float64(width)+0.5), 1)
+	}
+	if err := checkPixels(outWidth, outHeight); err != nil {
+		return nil, nil, err
+	}
+	// the decoded frame, and the resized frames kept for encoding
+	release, err := processing.acquire(imageMemory(width, height, 1) + imageMemory(outWidth, outHeight, count))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	interval := 1 / opts.FPS
+	// take the first frame at or after each target, allowing a half frame
+	tolerance := 0.0005
+	if frameDuration := d.FrameDuration(); frameDuration > 0 {
+		tolerance = frameDuration / 2
+	}
+
+	images := []image.Image{}
+	timestamps := []float64{}
+	d.Seek(opts.Start)
+	err = d.Decode(func(frame *gmf.Frame) (bool, error) {
+		ts := d.Seconds(frame.TimeStamp())
+		var m image.Image
+		// Repeat the frame if the video has fewer frames than the preview
+		// so the timing is kept.
+		for len(images) < count && ts >= opts.Start+float64(len(images))*interval-tolerance {
+			if m == nil {
+				m = imaging.Resize(d.Image(frame), outWidth, 0, imaging.Linear)
+			}
+			images = append(images, m)
+			timestamps = append(timestamps, ts)
+		}
+		return len(images) >= count, nil
+	})
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if len(images) == 0 {
+		return nil, nil, fmt.Errorf("no frame found after %v", opts.Start)
+	}
+	return images, timestamps, nil
+}
+
+// previewGIF encodes the frames as looping animated GIF.
+func previewGIF(images []image.Image, fps float64) ([]byte, error) {
+	// delay is in 1/100 seconds, and browsers slow down the smaller delays
+	delay := int(100/fps + 0.5)
+	if delay < 2 {
+		delay = 2
+	}
+	g := &gif.GIF{}
+	for _, m := range images {
+		g.Image = append(g.Image, toPaletted(m))
+		g.Delay = append(g.Delay, delay)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// previewMJPEG encodes the frames as multipart/x-mixed-replace, which
+// browsers show in <img> as motion JPEG.  It returns the content type with
+// the boundary.
+func previewMJPEG(images []image.Image, timestamps []float64) ([]byte, string, error) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	for i, m := range images {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":             {"image/jpeg"},
+			"X-Istore-Frame-Timestamp": {fmt.Sprintf("%.6f", timestamps[i])},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if err := jpeg.Encode(part, m, nil); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "multipart/x-mixed-replace; boundary=" + mw.Boundary(), nil
+}
+
+// preview makes a short animation of the video.  It returns the output,
+// its content type and the timestamp of the first frame.
+func preview(input io.Reader, opts *previewOptions) ([]byte, string, float64, error) {
+	images, timestamps, err := previewFrames(input, opts)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	switch opts.Format {
+	case "", "gif":
+		data, err := previewGIF(images, opts.FPS)
+		return data, "image/gif", timestamps[0], err
+	case "mjpeg":
+		data, ctype, err := previewMJPEG(images, timestamps)
+		return data, ctype, timestamps[0], err
+	}
+	return nil, "", 0, fmt.Errorf("unknown preview format %q", opts.Format)
+}
@@ -0,0 +1,64 @@
+package istore
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestPreviewEncode(c *C) {
+	images := []image.Image{
+		image.NewRGBA(image.Rect(0, 0, 8, 6)),
+		image.NewRGBA(image.Rect(0, 0, 8, 6)),
+	}
+
+	data, err := previewGIF(images, 10)
+	c.Assert(err, IsNil)
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Check(len(g.Image), Equals, 2)
+	c.Check(g.Delay, DeepEquals, []int{10, 10})
+	c.Check(g.LoopCount, Equals, 0)
+
+	data, ctype, err := previewMJPEG(images, []float64{1, 1.1})
+	c.Assert(err, IsNil)
+	mediatype, params, err := mime.ParseMediaType(ctype)
+	c.Assert(err, IsNil)
+	c.Check(mediatype, Equals, "multipart/x-mixed-replace")
+	mr := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+	for _, ts := range []string{"1.000000", "1.100000"} {
+		part, err := mr.NextPart()
+		c.Assert(err, IsNil)
+		c.Check(part.Header.Get("X-Istore-Frame-Timestamp"), Equals, ts)
+		body, _ := ioutil.ReadAll(part)
+		m, err := jpeg.Decode(bytes.NewReader(body))
+		c.Assert(err, IsNil)
+		c.Check(m.Bounds(), Equals, image.Rect(0, 0, 8, 6))
+	}
+}
+
+func (_ *S) TestParsePreviewOptions(c *C) {
+	parse := func(query string) (*previewOptions, error) {
+		r, _ := http.NewRequest("GET", "http://example.com/a?"+query, nil)
+		return parsePreviewOptions(r)
+	}
+
+	opts, err := parse("start=1.5&w=240")
+	c.Assert(err, IsNil)
+	c.Check(*opts, Equals, previewOptions{Start: 1.5, Duration: 3, FPS: 10, Width: 240})
+
+	for _, query := range []string{
+		"w=abc", "fps=fast", "start=-1", "duration=0", "w=100000",
+		"duration=60&fps=30", "duration=Inf", "fps=NaN",
+	} {
+		_, err := parse(query)
+		c.Check(errorStatus(err, nil), Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
@@ -0,0 +1,498 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/umitanuki/gmf"
+)
+
+// _MetaProbe is the reserved metadata key for the technical metadata.
+// Users cannot overwrite it by POST/PUT.
+const _MetaProbe = "_probe"
+
+// probeHeaderSize is the bytes read ahead to probe images, which is enough
+// for the image config and EXIF.  Videos are read by libav.
+const probeHeaderSize = 1 << 20
+
+// maxProbeMoovSize limits the MP4 moov box to keep for the rotation.
+const maxProbeMoovSize = 16 << 20
+
+// probe reads the technical metadata of the image or video.
+func probe(input io.Reader) (map[string]interface{}, error) {
+	header := make([]byte, probeHeaderSize)
+	n, err := io.ReadFull(input, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+	if config, format, err := image.DecodeConfig(bytes.NewReader(header)); err == nil {
+		return probeImage(header, config, format), nil
+	}
+	return probeVideo(header, io.MultiReader(bytes.NewReader(header), input))
+}
+
+func colorModelName(model color.Model) string {
+	if _, ok := model.(color.Palette); ok {
+		return "paletted"
+	}
+	switch model {
+	case color.RGBAModel:
+		return "rgba"
+	case color.RGBA64Model:
+		return "rgba64"
+	case color.NRGBAModel:
+		return "nrgba"
+	case color.NRGBA64Model:
+		return "nrgba64"
+	case color.AlphaModel:
+		return "alpha"
+	case color.Alpha16Model:
+		return "alpha16"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.YCbCrModel:
+		return "ycbcr"
+	}
+	return "unknown"
+}
+
+func probeImage(data []byte, config image.Config, format string) map[string]interface{} {
+	result := map[string]interface{}{
+		"type":        "image",
+		"format":      format,
+		"width":       int64(config.Width),
+		"height":      int64(config.Height),
+		"color_model": colorModelName(config.ColorModel),
+	}
+
+	if format == "jpeg" {
+		if tiff := jpegExif(data); tiff != nil {
+			exif, err := parseExif(tiff)
+			if err != nil {
+				glog.Info("failed to parse exif ", err)
+			} else if len(exif) > 0 {
+				result["exif"] = exif
+			}
+		}
+	}
+	return result
+}
+
+// containerFormat guesses the container format from the magic bytes.
+func containerFormat(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		if string(data[8:12]) == "qt  " {
+			return "mov"
+		}
+		return "mp4"
+	case bytes.HasPrefix(data, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		// DocType is in the EBML header
+		header := data
+		if len(header) > 64 {
+			header = header[:64]
+		}
+		if bytes.Contains(header, []byte("webm")) {
+			return "webm"
+		}
+		return "matroska"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "AVI ":
+		return "avi"
+	case bytes.HasPrefix(data, []byte("FLV")):
+		return "flv"
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "ogg"
+	case bytes.HasPrefix(data, []byte{0, 0, 1, 0xba}):
+		return "mpeg"
+	case len(data) > 188 && data[0] == 0x47 && data[188] == 0x47:
+		return "mpegts"
+	}
+	return ""
+}
+
+// mp4Box calls fn for each box in data until fn returns true.
+func mp4Box(data []byte, fn func(typ string, body []byte) bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return
+		}
+		if fn(typ, data[header:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+// mp4Rotation reads the clockwise rotation in degrees to display the video
+// track upright, from the matrix of MP4/QuickTime track header.
+func mp4Rotation(data []byte) (int, bool) {
+	rotation, found := 0, false
+	mp4Box(data, func(typ string, moov []byte) bool {
+		if typ != "moov" {
+			return false
+		}
+		mp4Box(moov, func(typ string, trak []byte) bool {
+			if typ != "trak" {
+				return false
+			}
+			mp4Box(trak, func(typ string, tkhd []byte) bool {
+				if typ != "tkhd" || len(tkhd) < 1 {
+					return false
+				}
+				// offset of the matrix depends on the version
+				offset := 40
+				if tkhd[0] == 1 {
+					offset = 52
+				}
+				if len(tkhd) < offset+44 {
+					return true
+				}
+				width := binary.BigEndian.Uint32(tkhd[offset+36:])
+				height := binary.BigEndian.Uint32(tkhd[offset+40:])
+				if width == 0 || height == 0 {
+					// not a video track
+					return true
+				}
+				a := int32(binary.BigEndian.Uint32(tkhd[offset:]))
+				b := int32(binary.BigEndian.Uint32(tkhd[offset+4:]))
+				deg := int(math.Floor(math.Atan2(float64(b), float64(a))*180/math.Pi + 0.5))
+				rotation, found = (deg+360)%360, true
+				return true
+			})
+			return found
+		})
+		return true
+	})
+	return rotation, found
+}
+
+// mp4MoovRecorder keeps the moov box of MP4/QuickTime while the stream is
+// read, as it may be at the end of the file.
+type mp4MoovRecorder struct {
+	io.Reader
+	head      []byte
+	remaining uint64
+	moov      *bytes.Buffer
+	done      bool
+}
+
+func (m *mp4MoovRecorder) Read(p []byte) (int, error) {
+	n, err := m.Reader.Read(p)
+	m.feed(p[:n])
+	return n, err
+}
+
+func (m *mp4MoovRecorder) feed(b []byte) {
+	for len(b) > 0 && !m.done {
+		if m.remaining > 0 {
+			k := uint64(len(b))
+			if k > m.remaining {
+				k = m.remaining
+			}
+			if m.moov != nil {
+				m.moov.Write(b[:k])
+			}
+			m.remaining -= k
+			b = b[k:]
+			if m.remaining == 0 && m.moov != nil {
+				m.done = true
+			}
+			continue
+		}
+
+		// the box header of 8 bytes, or 16 bytes with the 64-bit size
+		need := 8
+		if len(m.head) >= 8 && binary.BigEndian.Uint32(m.head) == 1 {
+			need = 16
+		}
+		k := need - len(m.head)
+		if k > len(b) {
+			k = len(b)
+		}
+		m.head = append(m.head, b[:k]...)
+		b = b[k:]
+		if len(m.head) < need || (need == 8 && binary.BigEndian.Uint32(m.head) == 1) {
+			continue
+		}
+
+		size := uint64(binary.BigEndian.Uint32(m.head))
+		if need == 16 {
+			size = binary.BigEndian.Uint64(m.head[8:])
+		}
+		if size < uint64(need) {
+			// the box to the end, or broken
+			m.done = true
+			return
+		}
+		m.remaining = size - uint64(need)
+		if string(m.head[4:8]) == "moov" {
+			if size > maxProbeMoovSize {
+				m.done = true
+				return
+			}
+			m.moov = bytes.NewBuffer(append([]byte{}, m.head...))
+			if m.remaining == 0 {
+				m.done = true
+			}
+		}
+		m.head = m.head[:0]
+	}
+}
+
+// Moov returns the whole moov box, or nil if it's not read yet.
+func (m *mp4MoovRecorder) Moov() []byte {
+	if m.moov == nil || m.remaining > 0 {
+		return nil
+	}
+	return m.moov.Bytes()
+}
+
+// streamCodecCtx opens the decoder of the stream.  gmf panics if the codec
+// is not supported, so it returns nil in that case.
+func streamCodecCtx(stream *gmf.Stream) (cc *gmf.CodecCtx) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Info(r)
+			cc = nil
+		}
+	}()
+	return stream.CodecCtx()
+}
+
+// probeVideo reads the video by libav.  header is the beginning of input
+// to tell the container.
+func probeVideo(header []byte, input io.Reader) (map[string]interface{}, error) {
+	container := containerFormat(header)
+	var recorder *mp4MoovRecorder
+	if container == "mp4" || container == "mov" {
+		recorder = &mp4MoovRecorder{Reader: input}
+		input = recorder
+	}
+
+	ctx, ioctx, err := openInput(input)
+	if err != nil {
+		return nil, err
+	}
+	opened := []*gmf.CodecCtx{}
+	defer func() {
+		// This is necessary to avoid leaking thread used by codec.
+		for _, cc := range opened {
+			cc.Close()
+		}
+		gmf.Release(ioctx)
+		ctx.CloseInputAndRelease()
+	}()
+
+	duration := float64(ctx.Duration()) / float64(gmf.AV_TIME_BASE)
+	result := map[string]interface{}{
+		"type":     "video",
+		"duration": duration,
+	}
+	if container != "" {
+		result["container"] = container
+	}
+
+	bitRate := int64(0)
+	streams := []interface{}{}
+	for i := 0; i < ctx.StreamsCnt(); i++ {
+		stream, err := ctx.GetStream(i)
+		if err != nil {
+			return nil, err
+		}
+		info := map[string]interface{}{
+			"index": int64(i),
+			"type":  "unknown",
+		}
+		streams = append(streams, info)
+
+		cc := streamCodecCtx(stream)
+		if cc == nil {
+			continue
+		}
+		opened = append(opened, cc)
+		info["codec"] = cc.Codec().Name()
+		if rate := cc.BitRate(); rate > 0 {
+			info["bit_rate"] = int64(rate)
+			bitRate += int64(rate)
+		}
+
+		switch cc.Type() {
+		case gmf.AVMEDIA_TYPE_VIDEO:
+			info["type"] = "video"
+			info["width"] = int64(cc.Width())
+			info["height"] = int64(cc.Height())
+			if d := frameDuration(stream); d > 0 {
+				info["fps"] = 1 / d
+			}
+			if _, ok := result["codec"]; !ok {
+				// the first video stream describes the item
+				result["codec"] = info["codec"]
+				result["width"] = info["width"]
+				result["height"] = info["height"]
+				if fps, ok := info["fps"]; ok {
+					result["fps"] = fps
+				}
+			}
+		case gmf.AVMEDIA_TYPE_AUDIO:
+			info["type"] = "audio"
+			info["sample_rate"] = int64(cc.SampleRate())
+			info["channels"] = int64(cc.Channels())
+			if _, ok := result["audio_codec"]; !ok {
+				result["audio_codec"] = info["codec"]
+			}
+		default:
+			info["type"] = "other"
+		}
+	}
+	result["streams"] = streams
+	// libav doesn't tell the overall bit rate here, so it's the sum of
+	// the streams
+	if bitRate > 0 {
+		result["bit_rate"] = bitRate
+	}
+
+	if recorder != nil {
+		if rotation, ok := mp4Rotation(recorder.Moov()); ok {
+			result["rotation"] = int64(rotation)
+		}
+	}
+
+	return result, nil
+}
+
+// recordProbe stores the technical metadata to the existing item.
+func (s *Server) recordProbe(key string, info map[string]interface{}) error {
+	data, err := s.Db.Get([]byte(key), nil)
+	if err != nil {
+		return err
+	}
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(data); err != nil {
+		return err
+	}
+	if meta.MetaData == nil {
+		meta.MetaData = map[string]interface{}{}
+	}
+	meta.MetaData[_MetaProbe] = info
+
+	metabytes, err := meta.MarshalMsg(nil)
+	if err != nil {
+		return err
+	}
+	return s.Db.Put([]byte(key), metabytes, nil)
+}
+
+// probeItem fetches the object of the item and records its technical
+// metadata.
+func (s *Server) probeItem(key string) (map[string]interface{}, error) {
+	Url := extractTargetURL(key)
+	if Url == "" {
+		return nil, fmt.Errorf("target not found in path %s", key)
+	}
+	resp, err := s.Client.Get(Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", Url, resp.Status)
+	}
+
+	info, err := probe(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return info, s.recordProbe(key, info)
+}
+
+type ProbeResult struct {
+	FilePath string                 `json:"_filepath"`
+	Probe    map[string]interface{} `json:"_probe,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+func (s *Server) probeDir(dir string, h *jobHandle) ([]ProbeResult, error) {
+	keys := []string{}
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() {
+		if key := string(iter.Key()); extractTargetURL(key) != "" {
+			keys = append(keys, key)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	results := []ProbeResult{}
+	for i, key := range keys {
+		if h.Canceled() {
+			return nil, errJobCanceled
+		}
+		h.SetProgress(float64(i) / float64(len(keys)))
+
+		result := ProbeResult{FilePath: key}
+		info, err := s.probeItem(key)
+		if err != nil {
+			glog.Error(err)
+			result.Error = err.Error()
+		} else {
+			result.Probe = info
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Probe records technical metadata of every item under the directory.
+func (s *Server) Probe(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	dir = dir[0 : len(dir)-len("_probe")]
+	if !strings.HasSuffix(dir, "/") {
+		http.Error(w, "probe should finish with '/'", http.StatusBadRequest)
+		return
+	}
+
+	if isAsync(r) {
+		s.SubmitJob(w, "probe", dir, nil)
+		return
+	}
+
+	results, err := s.probeDir(dir, nil)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header()["Content-type"] = []string{"application/json"}
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		glog.Error(err)
+	}
+}
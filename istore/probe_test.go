@@ -0,0 +1,217 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing/iotest"
+
+	. "gopkg.in/check.v1"
+)
+
+// tiffBuilder writes little-endian TIFF for tests.
+type tiffBuilder struct {
+	buf bytes.Buffer
+}
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func rationals(values ...uint32) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = append(b, le32(v)...)
+	}
+	return b
+}
+
+// ifd writes the IFD at the current end and returns its offset.
+func (t *tiffBuilder) ifd(fields []tiffField) uint32 {
+	offset := uint32(t.buf.Len())
+	valoff := offset + 2 + uint32(len(fields))*12 + 4
+	extra := []byte{}
+	t.buf.Write(le16(uint16(len(fields))))
+	for _, f := range fields {
+		t.buf.Write(le16(f.tag))
+		t.buf.Write(le16(f.typ))
+		t.buf.Write(le32(f.count))
+		if len(f.value) <= 4 {
+			t.buf.Write(append(f.value, make([]byte, 4-len(f.value))...))
+		} else {
+			t.buf.Write(le32(valoff + uint32(len(extra))))
+			extra = append(extra, f.value...)
+		}
+	}
+	t.buf.Write(le32(0))
+	t.buf.Write(extra)
+	return offset
+}
+
+func makeExif() []byte {
+	t := &tiffBuilder{}
+	t.buf.WriteString("II")
+	t.buf.Write(le16(42))
+	t.buf.Write(le32(0)) // IFD0 offset, written later
+
+	exif := t.ifd([]tiffField{
+		{_ExifTagDateTimeOriginal, 2, 20, []byte("2015:06:01 12:34:56\x00")},
+	})
+	gps := t.ifd([]tiffField{
+		{_GPSTagLatitudeRef, 2, 2, []byte("N\x00")},
+		{_GPSTagLatitude, 5, 3, rationals(35, 1, 30, 1, 0, 1)},
+		{_GPSTagLongitudeRef, 2, 2, []byte("W\x00")},
+		{_GPSTagLongitude, 5, 3, rationals(139, 1, 45, 1, 0, 1)},
+	})
+	ifd0 := t.ifd([]tiffField{
+		{_ExifTagMake, 2, 6, []byte("Canon\x00")},
+		{_ExifTagOrientation, 3, 1, le16(6)},
+		{_ExifTagExifIFD, 4, 1, le32(exif)},
+		{_ExifTagGPSIFD, 4, 1, le32(gps)},
+	})
+
+	data := t.buf.Bytes()
+	binary.LittleEndian.PutUint32(data[4:], ifd0)
+	return data
+}
+
+// jpegWithExif makes 8x4 JPEG with the Exif (orientation 6).
+func jpegWithExif() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, img, nil)
+
+	// insert APP1 after SOI
+	segment := append([]byte("Exif\x00\x00"), makeExif()...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	data := append([]byte{0xff, 0xd8}, app1...)
+	data = append(data, segment...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func (_ *S) TestExif(c *C) {
+	data := jpegWithExif()
+	c.Check(jpegExif(data), DeepEquals, makeExif())
+
+	info, err := probe(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Check(info["format"], Equals, "jpeg")
+	c.Check(info["width"], Equals, int64(8))
+	c.Check(info["height"], Equals, int64(4))
+
+	exif := info["exif"].(map[string]interface{})
+	c.Check(exif["make"], Equals, "Canon")
+	c.Check(exif["orientation"], Equals, int64(6))
+	c.Check(exif["capture_time"], Equals, "2015-06-01T12:34:56")
+	gps := exif["gps"].(map[string]interface{})
+	c.Check(gps["latitude"], Equals, 35.5)
+	c.Check(gps["longitude"], Equals, -139.75)
+}
+
+func (_ *S) TestAutoOrient(c *C) {
+	data := jpegWithExif()
+	size := func(output []byte) image.Point {
+		config, _, err := image.DecodeConfig(bytes.NewReader(output))
+		c.Assert(err, IsNil)
+		return image.Pt(config.Width, config.Height)
+	}
+	identity := func(m image.Image) image.Image { return m }
+
+	// rotated 90 degrees clockwise
+	output, err := processImage(bytes.NewReader(data), identity)
+	c.Assert(err, IsNil)
+	c.Check(size(output), Equals, image.Pt(4, 8))
+	c.Check(jpegExif(output), IsNil)
+
+	AutoOrient = false
+	defer func() { AutoOrient = true }()
+	output, _ = processImage(bytes.NewReader(data), identity)
+	c.Check(size(output), Equals, image.Pt(8, 4))
+	output, _ = autoOrient(bytes.NewReader(data))
+	c.Check(size(output), Equals, image.Pt(4, 8))
+}
+
+func mp4TestBox(typ string, body []byte) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func (_ *S) TestMp4Rotation(c *C) {
+	tkhd := make([]byte, 84)
+	be := binary.BigEndian
+	// matrix of 90 degrees rotation
+	be.PutUint32(tkhd[40:], 0)
+	be.PutUint32(tkhd[44:], 0x10000)
+	be.PutUint32(tkhd[52:], 0xffff0000)
+	be.PutUint32(tkhd[76:], 1920<<16)
+	be.PutUint32(tkhd[80:], 1080<<16)
+
+	data := mp4TestBox("ftyp", []byte("isom"))
+	data = append(data, mp4TestBox("moov", mp4TestBox("trak", mp4TestBox("tkhd", tkhd)))...)
+
+	rotation, ok := mp4Rotation(data)
+	c.Check(ok, Equals, true)
+	c.Check(rotation, Equals, 90)
+	c.Check(containerFormat(data), Equals, "mp4")
+
+	// moov after mdat, read byte by byte
+	moov := data[len(mp4TestBox("ftyp", []byte("isom"))):]
+	stream := append(mp4TestBox("ftyp", []byte("isom")), mp4TestBox("mdat", make([]byte, 1000))...)
+	stream = append(stream, moov...)
+	recorder := &mp4MoovRecorder{Reader: iotest.OneByteReader(bytes.NewReader(stream))}
+	ioutil.ReadAll(recorder)
+	c.Check(recorder.Moov(), DeepEquals, moov)
+	rotation, ok = mp4Rotation(recorder.Moov())
+	c.Check(ok, Equals, true)
+	c.Check(rotation, Equals, 90)
+}
+
+func (_ *S) TestProbe(c *C) {
+	server := newTestServer()
+	imgfile := testdataFile("sample.jpg")
+
+	mock := server.request("POST", "/path/probe/file://"+imgfile+"?probe=1", "")
+	c.Check(mock.status, Equals, http.StatusCreated)
+	meta := ItemMeta{}
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &meta), IsNil)
+	probed := meta.MetaData[_MetaProbe].(map[string]interface{})
+	c.Check(probed["type"], Equals, "image")
+	c.Check(probed["format"], Equals, "jpeg")
+
+	// users cannot overwrite
+	metadata := url.QueryEscape(`{"_probe":1,"name":"Bob"}`)
+	mock = server.request("PUT", "/path/probe/file://"+imgfile+"?metadata="+metadata, "")
+	meta = ItemMeta{}
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &meta), IsNil)
+	c.Check(meta.MetaData["name"], Equals, "Bob")
+	c.Check(meta.MetaData[_MetaProbe], DeepEquals, probed)
+
+	results := []ProbeResult{}
+	mock = server.request("POST", "/path/probe/_probe", "")
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &results), IsNil)
+	c.Assert(len(results), Equals, 1)
+	c.Check(results[0].Error, Equals, "")
+	c.Check(results[0].Probe["width"], Equals, probed["width"])
+}
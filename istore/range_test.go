@@ -0,0 +1,48 @@
+package istore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestRange(c *C) {
+	server := newTestServer()
+
+	testdata := testdataFile("sample.jpg")
+	content, _ := ioutil.ReadFile(testdata)
+
+	request := func(method, path, rangeSpec string) *mockWriter {
+		r, _ := http.NewRequest(method, "http://example.com"+path, nil)
+		if rangeSpec != "" {
+			r.Header.Set("Range", rangeSpec)
+		}
+		return server.do(r)
+	}
+
+	mock := request("POST", "/path/range/file://"+testdata, "")
+	c.Check(mock.status, Equals, http.StatusCreated)
+
+	mock = request("GET", "/path/range/file://"+testdata, "")
+	c.Check(mock.status, Equals, http.StatusOK)
+	c.Check(mock.header.Get("Accept-Ranges"), Equals, "bytes")
+
+	mock = request("GET", "/path/range/file://"+testdata, "bytes=10-19")
+	c.Check(mock.status, Equals, http.StatusPartialContent)
+	c.Check(mock.header.Get("Content-Range"), Equals, fmt.Sprintf("bytes 10-19/%d", len(content)))
+	c.Check(bytes.Equal(mock.body.Bytes(), content[10:20]), Equals, true)
+
+	// multiple ranges
+	mock = request("GET", "/path/range/file://"+testdata, "bytes=0-9,20-29")
+	c.Check(mock.status, Equals, http.StatusPartialContent)
+	c.Check(strings.HasPrefix(mock.header.Get("Content-Type"), "multipart/byteranges"), Equals, true)
+
+	// processed output can be ranged too
+	mock = request("GET", "/path/range/file://"+testdata+"?apply=resize&w=100", "bytes=0-1")
+	c.Check(mock.status, Equals, http.StatusPartialContent)
+	c.Check(mock.body.Bytes(), DeepEquals, []byte{0xff, 0xd8})
+}
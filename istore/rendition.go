@@ -0,0 +1,199 @@
+package istore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	levelutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RenditionCacheSize is the size in bytes of the cache of processed output,
+// separate from the cache of origin objects.  0 disables it.
+var RenditionCacheSize = 1 << 30
+
+// MaxCachedRendition is the largest output to cache, so that e.g. a clip of
+// video doesn't evict many thumbnails.
+var MaxCachedRendition = 16 << 20
+
+// renditionKey identifies the output by the source URL, its validator and
+// the normalized apply parameters, see renditionQuery.  It returns "" if the source has no
+// validator, as the output can't be told stale then.
+func renditionKey(Url string, source http.Header, r *http.Request) string {
+	etag := renditionETag(source, r)
+	if etag == "" {
+		return ""
+	}
+	return Url + "\n" + etag
+}
+
+// cachedApply returns the output from the rendition cache, or processes
+// the source by handleApply and caches the output.
+func (s *Server) cachedApply(Url string, resp *http.Response, r *http.Request) (*http.Response, error) {
+	apply := r.FormValue("apply")
+	if s.Renditions == nil || (apply == "" && r.FormValue("output") == "") {
+		return handleApply(resp, r)
+	}
+	if apply == "clip" || apply == "transcode" {
+		// cached on disk, see TranscodeCacheDir
+		return handleApply(resp, r)
+	}
+	key := renditionKey(Url, resp.Header, r)
+	if key == "" {
+		return handleApply(resp, r)
+	}
+
+	if data, ok := s.Renditions.Get(key); ok {
+		resp.Body.Close()
+		newresp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), r)
+		if err != nil {
+			return nil, err
+		}
+		newresp.Header.Set("Date", time.Now().Format(time.RFC1123))
+		return newresp, nil
+	}
+
+	newresp, err := handleApply(resp, r)
+	if err != nil || newresp.StatusCode != http.StatusOK || r.Method != "GET" {
+		return newresp, err
+	}
+	if newresp.ContentLength < 0 || newresp.ContentLength > int64(MaxCachedRendition) {
+		return newresp, nil
+	}
+	// DumpResponse leaves the body to read again.
+	data, err := httputil.DumpResponse(newresp, true)
+	if err != nil {
+		return nil, err
+	}
+	s.Renditions.Set(key, data)
+	return newresp, nil
+}
+
+// fetchItem gets the item by GetApply with the query.
+func (s *Server) fetchItem(key, query string) ([]byte, *http.Response, error) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.URL = &url.URL{Path: key, RawQuery: query}
+
+	resp, err := s.GetApply(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &statusError{
+			Code:    resp.StatusCode,
+			Message: key + " returned status: " + resp.Status,
+		}
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, resp, nil
+}
+
+type WarmArgs struct {
+	// Queries are the apply parameters of the renditions to make, e.g.
+	// "apply=resize&w=200".
+	Queries []string `json:"queries"`
+}
+
+type WarmResult struct {
+	FilePath string `json:"_filepath"`
+	Query    string `json:"query"`
+	Size     int    `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// warmDir makes the renditions of every item under the directory, so that
+// they are served from the rendition cache.
+func (s *Server) warmDir(dir string, args *WarmArgs, h *jobHandle) ([]WarmResult, error) {
+	keys := []string{}
+	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(dir)), nil)
+	for iter.Next() {
+		if key := string(iter.Key()); extractTargetURL(key) != "" {
+			keys = append(keys, key)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	results := []WarmResult{}
+	total := len(keys) * len(args.Queries)
+	for i, key := range keys {
+		for j, query := range args.Queries {
+			if h.Canceled() {
+				return nil, errJobCanceled
+			}
+			h.SetProgress(float64(i*len(args.Queries)+j) / float64(total))
+
+			result := WarmResult{FilePath: key, Query: query}
+			data, _, err := s.fetchItem(key, query)
+			if err != nil {
+				glog.Error(err)
+				result.Error = strings.TrimSpace(err.Error())
+			} else {
+				result.Size = len(data)
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// Warm makes the renditions of the queries for every item under the
+// directory.
+func (s *Server) Warm(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	dir = dir[0 : len(dir)-len("_warm")]
+	if !strings.HasSuffix(dir, "/") {
+		http.Error(w, "warm should finish with '/'", http.StatusBadRequest)
+		return
+	}
+
+	args := WarmArgs{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(body, &args) != nil {
+		http.Error(w, "unrecognized args", http.StatusBadRequest)
+		return
+	}
+	if len(args.Queries) == 0 {
+		http.Error(w, "queries are required", http.StatusBadRequest)
+		return
+	}
+	for _, query := range args.Queries {
+		if _, err := url.ParseQuery(query); err != nil {
+			http.Error(w, "invalid query "+query, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if isAsync(r) {
+		s.SubmitJob(w, "warm", dir, &args)
+		return
+	}
+
+	results, err := s.warmDir(dir, &args, nil)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header()["Content-type"] = []string{"application/json"}
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		glog.Error(err)
+	}
+}
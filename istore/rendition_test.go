@@ -0,0 +1,56 @@
+package istore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestRenditionCache(c *C) {
+	defer func(n int) { MaxPixels = n }(MaxPixels)
+
+	server := newTestServer()
+
+	// copy the sample so we can change it later
+	data, _ := ioutil.ReadFile(testdataFile("sample.jpg"))
+	testdata := filepath.Join(server.Dir, "sample.jpg")
+	ioutil.WriteFile(testdata, data, 0644)
+	server.request("POST", "/path/rendition/file://"+testdata, "")
+
+	request := func(query string) *mockWriter {
+		return server.request("GET", "/path/rendition/file://"+testdata+"?"+query, "")
+	}
+	first := request("apply=resize&w=100")
+	c.Check(first.status, Equals, http.StatusOK)
+
+	mock := server.request("POST", "/path/rendition/_warm", `{"queries": ["apply=resize&w=60"]}`)
+	c.Check(mock.status, Equals, http.StatusOK)
+	results := []WarmResult{}
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &results), IsNil)
+	c.Assert(len(results), Equals, 1)
+	c.Check(results[0].Error, Equals, "")
+	c.Check(results[0].Size > 0, Equals, true)
+
+	// The cached renditions are served without processing.
+	MaxPixels = 1
+	cached := request("w=100&apply=resize")
+	c.Check(cached.status, Equals, http.StatusOK)
+	c.Check(cached.body.Bytes(), DeepEquals, first.body.Bytes())
+	c.Check(cached.header.Get("Etag"), Equals, first.header.Get("Etag"))
+	// the parameters not read by resize
+	cached = request("apply=resize&w=100&_=1234&anchor=top")
+	c.Check(cached.status, Equals, http.StatusOK)
+	c.Check(cached.header.Get("Etag"), Equals, first.header.Get("Etag"))
+	c.Check(request("apply=resize&w=60").status, Equals, http.StatusOK)
+	c.Check(request("apply=resize&w=80").status, Equals, http.StatusRequestEntityTooLarge)
+
+	// the source has changed
+	modified := time.Now().Add(time.Hour)
+	os.Chtimes(testdata, modified, modified)
+	c.Check(request("apply=resize&w=100").status, Equals, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,151 @@
+package istore
+
+import (
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// resampleFilters are the filters of imaging by lower case names.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearestneighbor":   imaging.NearestNeighbor,
+	"nearest":           imaging.NearestNeighbor,
+	"box":               imaging.Box,
+	"linear":            imaging.Linear,
+	"hermite":           imaging.Hermite,
+	"mitchellnetravali": imaging.MitchellNetravali,
+	"catmullrom":        imaging.CatmullRom,
+	"bspline":           imaging.BSpline,
+	"gaussian":          imaging.Gaussian,
+	"bartlett":          imaging.Bartlett,
+	"lanczos":           imaging.Lanczos,
+	"hann":              imaging.Hann,
+	"hamming":           imaging.Hamming,
+	"blackman":          imaging.Blackman,
+	"welch":             imaging.Welch,
+	"cosine":            imaging.Cosine,
+}
+
+// parseFilter returns the resampling filter by name, Lanczos by default.
+func parseFilter(name string) (imaging.ResampleFilter, error) {
+	if name == "" {
+		return imaging.Lanczos, nil
+	}
+	filter, ok := resampleFilters[strings.ToLower(name)]
+	if !ok {
+		return imaging.ResampleFilter{}, badRequest("unknown filter %q", name)
+	}
+	return filter, nil
+}
+
+// MaxResizePercent limits percent of resize and fit.
+var MaxResizePercent = 1000.0
+
+type resizeOptions struct {
+	// Width and Height are the size.  0 keeps the aspect ratio.
+	Width, Height int
+	// Percent scales the image instead of Width and Height, if positive.
+	Percent float64
+	// MaxWidth and MaxHeight shrink the output keeping its aspect ratio,
+	// if positive.
+	MaxWidth, MaxHeight int
+	// Fit keeps the aspect ratio of the image within Width x Height.
+	Fit bool
+	// Upscale allows the output larger than the image.
+	Upscale bool
+	Filter  imaging.ResampleFilter
+}
+
+func parseBool(s string, defval bool) (bool, error) {
+	if s == "" {
+		return defval, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// parseResizeOptions reads w, h, percent, max_w, max_h, upscale and filter.
+// Only fit doesn't upscale by default.  Invalid args are errors of 400.
+func parseResizeOptions(r *http.Request, fit bool) (*resizeOptions, error) {
+	opts := &resizeOptions{Fit: fit}
+	for name, value := range map[string]*int{
+		"w": &opts.Width, "h": &opts.Height, "max_w": &opts.MaxWidth, "max_h": &opts.MaxHeight,
+	} {
+		n, err := formDimension(r, name)
+		if err != nil {
+			return nil, err
+		}
+		*value = n
+	}
+	if v := r.FormValue("percent"); v != "" {
+		percent, err := strconv.ParseFloat(v, 64)
+		// written to fail with NaN
+		if err != nil || !(percent > 0 && percent <= MaxResizePercent) {
+			return nil, badRequest("invalid percent %q", v)
+		}
+		opts.Percent = percent
+	}
+
+	var err error
+	if opts.Upscale, err = parseBool(r.FormValue("upscale"), !fit); err != nil {
+		return nil, badRequest("invalid upscale %q", r.FormValue("upscale"))
+	}
+	if opts.Filter, err = parseFilter(r.FormValue("filter")); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// size returns the output size for the image of src.
+func (opts *resizeOptions) size(src image.Point) image.Point {
+	sx, sy := float64(src.X), float64(src.Y)
+	w, h := float64(opts.Width), float64(opts.Height)
+	switch {
+	case opts.Percent > 0:
+		w, h = sx*opts.Percent/100, sy*opts.Percent/100
+	case opts.Fit && (w > 0 || h > 0):
+		scale := math.Inf(1)
+		if w > 0 {
+			scale = w / sx
+		}
+		if h > 0 {
+			scale = math.Min(scale, h/sy)
+		}
+		w, h = sx*scale, sy*scale
+	case w == 0 && h == 0:
+		w, h = sx, sy
+	case w == 0:
+		w = sx * h / sy
+	case h == 0:
+		h = sy * w / sx
+	}
+
+	// shrink both to keep the aspect ratio
+	scale := 1.0
+	if opts.MaxWidth > 0 {
+		scale = math.Min(scale, float64(opts.MaxWidth)/w)
+	}
+	if opts.MaxHeight > 0 {
+		scale = math.Min(scale, float64(opts.MaxHeight)/h)
+	}
+	if !opts.Upscale {
+		scale = math.Min(scale, math.Min(sx/w, sy/h))
+	}
+	w, h = w*scale, h*scale
+
+	return image.Pt(maxInt(int(w+0.5), 1), maxInt(int(h+0.5), 1))
+}
+
+// resizeImage resizes m by the options.  m is returned as is if the size
+// doesn't change.
+func resizeImage(m image.Image, opts *resizeOptions) image.Image {
+	src := m.Bounds().Size()
+	size := opts.size(src)
+	if size == src {
+		return m
+	}
+	return imaging.Resize(m, size.X, size.Y, opts.Filter)
+}
@@ -0,0 +1,44 @@
+package istore
+
+import (
+	"image"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestResizeOptions(c *C) {
+	src := image.Pt(400, 200)
+	size := func(query string, fit bool) image.Point {
+		r, _ := http.NewRequest("GET", "http://example.com/?"+query, nil)
+		opts, err := parseResizeOptions(r, fit)
+		c.Assert(err, IsNil, Commentf("%s", query))
+		return opts.size(src)
+	}
+
+	c.Check(size("w=100&h=100", false), Equals, image.Pt(100, 100))
+	c.Check(size("w=100", false), Equals, image.Pt(100, 50))
+	c.Check(size("w=800", false), Equals, image.Pt(800, 400))
+	c.Check(size("w=800&upscale=false", false), Equals, image.Pt(400, 200))
+	c.Check(size("w=800&h=800&upscale=0", false), Equals, image.Pt(200, 200))
+	c.Check(size("percent=25", false), Equals, image.Pt(100, 50))
+	c.Check(size("w=300&max_w=150", false), Equals, image.Pt(150, 75))
+	c.Check(size("max_h=100", false), Equals, image.Pt(200, 100))
+
+	c.Check(size("w=100&h=100", true), Equals, image.Pt(100, 50))
+	c.Check(size("h=100", true), Equals, image.Pt(200, 100))
+	c.Check(size("w=800&h=800", true), Equals, image.Pt(400, 200))
+	c.Check(size("w=800&h=800&upscale=true", true), Equals, image.Pt(800, 400))
+
+	filter, err := parseFilter("CatmullRom")
+	c.Assert(err, IsNil)
+	c.Check(filter.Support, Equals, 2.0)
+	for _, query := range []string{
+		"filter=cubic", "percent=-1", "w=x", "upscale=maybe",
+		"w=100000", "max_h=100000", "percent=100000", "percent=NaN",
+	} {
+		r, _ := http.NewRequest("GET", "http://example.com/?"+query, nil)
+		_, err := parseResizeOptions(r, false)
+		c.Check(errorStatus(err, nil), Equals, http.StatusBadRequest, Commentf("%s", query))
+	}
+}
@@ -0,0 +1,99 @@
+package istore
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// boxCoords reads the integer coordinates of the box for crop.
+func boxCoords(box map[string]interface{}) ([4]int, error) {
+	coords := [4]int{}
+	for i, name := range []string{"x1", "y1", "x2", "y2"} {
+		v, ok := metaFloat(box[name])
+		if !ok {
+			return coords, fmt.Errorf("box %v has no %s", box, name)
+		}
+		coords[i] = int(math.Floor(v + 0.5))
+	}
+	if coords[0] > coords[2] {
+		coords[0], coords[2] = coords[2], coords[0]
+	}
+	if coords[1] > coords[3] {
+		coords[1], coords[3] = coords[3], coords[1]
+	}
+	return coords, nil
+}
+
+// expandRegions registers the crop of each box in the metadata field of the
+// image item, with the label, score and the parent in the metadata.
+func (s *Server) expandRegions(dir string, args *ExpandArgs, h *jobHandle) error {
+	objkey := args.Image
+	data, err := s.Db.Get([]byte(objkey), nil)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", objkey, err)
+	}
+	parent := ItemMeta{}
+	if _, err := parent.UnmarshalMsg(data); err != nil {
+		return err
+	}
+
+	value, ok := parent.MetaData[args.Boxes]
+	if !ok {
+		return nil
+	}
+	boxes, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("metadata %s is not a list", args.Boxes)
+	}
+
+	batch := new(leveldb.Batch)
+	for i, b := range boxes {
+		if h.Canceled() {
+			return errJobCanceled
+		}
+		h.SetProgress(float64(i) / float64(len(boxes)))
+
+		box, ok := b.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("box %v in %s is not an object", b, args.Boxes)
+		}
+		score, hasScore := metaFloat(box["score"])
+		if hasScore && score < args.Threshold {
+			continue
+		}
+		coords, err := boxCoords(box)
+		if err != nil {
+			return err
+		}
+		if coords[0] == coords[2] || coords[1] == coords[3] {
+			// empty
+			continue
+		}
+
+		key := dir + selfURL(objkey) +
+			fmt.Sprintf("?apply=crop&x1=%d&y1=%d&x2=%d&y2=%d", coords[0], coords[1], coords[2], coords[3])
+		meta := map[string]interface{}{
+			"image":  objkey,
+			"parent": parent.ItemId,
+			"index":  i,
+			"box": map[string]int{
+				"x1": coords[0], "y1": coords[1], "x2": coords[2], "y2": coords[3],
+			},
+		}
+		if label, ok := box["label"]; ok {
+			meta["label"] = label
+		}
+		if hasScore {
+			meta["score"] = score
+		}
+		value, _ := json.Marshal(&meta)
+		if _, _, err := s.PutObject([]byte(key), string(value), batch, true); err != nil {
+			return err
+		}
+	}
+
+	return s.Db.Write(batch, nil)
+}
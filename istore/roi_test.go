@@ -0,0 +1,44 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestExpandRegions(c *C) {
+	server := newTestServer()
+	imgfile := testdataFile("sample.jpg")
+
+	source := "/path/photos/file://" + imgfile
+	metadata := url.QueryEscape(`{"objects": [
+		{"x1": 10.4, "y1": 20, "x2": 40, "y2": 30, "label": "cat", "score": 0.9},
+		{"x1": 1, "y1": 1, "x2": 5, "y2": 5, "label": "dog", "score": 0.2}]}`)
+	mock := server.request("POST", source+"?metadata="+metadata, "")
+	parent := ItemMeta{}
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &parent), IsNil)
+
+	mock = server.request("POST", "/path/rois/_expand", `{"boxes": "objects"}`)
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	server.request("POST", "/path/rois/_expand", `{"image": "`+source+`", "boxes": "objects", "threshold": 0.5}`)
+
+	items := []ItemMeta{}
+	mock = server.request("GET", "/path/rois/", "")
+	c.Assert(json.Unmarshal(mock.body.Bytes(), &items), IsNil)
+	c.Assert(len(items), Equals, 1)
+	c.Check(strings.HasSuffix(items[0].FilePath, "?apply=crop&x1=10&y1=20&x2=40&y2=30"), Equals, true)
+	c.Check(items[0].MetaData["label"], Equals, "cat")
+	c.Check(items[0].MetaData["score"], Equals, 0.9)
+	c.Check(items[0].MetaData["parent"], Equals, float64(parent.ItemId))
+
+	// the key has raw '?' of the crop
+	mock = server.request("GET", strings.NewReplacer("%", "%25", "?", "%3F").Replace(items[0].FilePath), "")
+	config, _, err := image.DecodeConfig(bytes.NewReader(mock.body.Bytes()))
+	c.Assert(err, IsNil)
+	c.Check([]int{config.Width, config.Height}, DeepEquals, []int{30, 10})
+}
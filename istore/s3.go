@@ -0,0 +1,226 @@
+package istore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	_S3Service       = "s3"
+	_S3DefaultRegion = "us-east-1"
+	_S3EmptyHash     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	_S3TimeFormat    = "20060102T150405Z"
+	_S3DateFormat    = "20060102"
+)
+
+// S3Config holds the endpoint and credentials used to resolve s3:// URLs.
+type S3Config struct {
+	// Endpoint is the base URL of the S3-compatible service, such as
+	// "http://localhost:9000" for MinIO.  If empty, AWS S3 of Region is used.
+	Endpoint string
+	Region   string
+	// PathStyle requests http://endpoint/bucket/key instead of
+	// http://bucket.endpoint/key.  Most S3-compatible services want this.
+	PathStyle       bool
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// NewS3ConfigFromEnv builds S3Config from the standard AWS environment
+// variables plus ISTORE_S3_ENDPOINT and ISTORE_S3_PATH_STYLE.
+func NewS3ConfigFromEnv() *S3Config {
+	config := &S3Config{
+		Endpoint:        os.Getenv("ISTORE_S3_ENDPOINT"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if config.Region == "" {
+		config.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if config.Region == "" {
+		config.Region = _S3DefaultRegion
+	}
+	switch os.Getenv("ISTORE_S3_PATH_STYLE") {
+	case "", "0", "false":
+		// custom endpoints are mostly MinIO and friends
+		config.PathStyle = config.Endpoint != ""
+	default:
+		config.PathStyle = true
+	}
+
+	return config
+}
+
+// objectURL maps s3://bucket/key to the http(s) URL of the object.
+func (c *S3Config) objectURL(bucket, key string) (*url.URL, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		if c.Region == _S3DefaultRegion {
+			endpoint = "https://s3.amazonaws.com"
+		} else {
+			endpoint = "https://s3." + c.Region + ".amazonaws.com"
+		}
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+	if c.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+
+	return u, nil
+}
+
+func (s *Server) s3Get(req *http.Request) (*http.Response, error) {
+	config := s.S3
+	if config == nil {
+		config = NewS3ConfigFromEnv()
+	}
+
+	bucket := req.URL.Host
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is missing in %s", req.URL)
+	}
+	objurl, err := config.objectURL(bucket, req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	newreq, err := http.NewRequest(req.Method, objurl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	newreq.URL = objurl
+	// pass through conditional and range headers
+	for _, h := range []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if v := req.Header.Get(h); v != "" {
+			newreq.Header.Set(h, v)
+		}
+	}
+
+	if config.AccessKeyId != "" {
+		signV4(newreq, config, time.Now())
+	}
+
+	client := &http.Client{}
+	return client.Do(newreq)
+}
+
+// signV4 signs an empty-body request with AWS Signature Version 4.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, config *S3Config, now time.Time) {
+	now = now.UTC()
+	amzdate := now.Format(_S3TimeFormat)
+	scope := strings.Join([]string{now.Format(_S3DateFormat), config.Region, _S3Service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", _S3EmptyHash)
+	if config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", config.SessionToken)
+	}
+
+	// canonical headers, host and every x-amz-* plus range
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		lkey := strings.ToLower(key)
+		if strings.HasPrefix(lkey, "x-amz-") || lkey == "range" {
+			headers[lkey] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonHeaders := ""
+	for _, name := range names {
+		canonHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonHeaders,
+		signedHeaders,
+		_S3EmptyHash,
+	}, "\n")
+
+	hashed := sha256.Sum256([]byte(canonRequest))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretAccessKey), now.Format(_S3DateFormat))
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, _S3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		config.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath URI-encodes each byte as S3 expects, except '/'.
+func s3EscapePath(path string) string {
+	buf := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+func s3CanonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		vals := values[key]
+		sort.Strings(vals)
+		for _, val := range vals {
+			pairs = append(pairs, strings.Replace(s3EscapePath(key), "/", "%2F", -1)+"="+
+				strings.Replace(s3EscapePath(val), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
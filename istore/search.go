@@ -3,6 +3,7 @@ package istore
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"sort"
 )
 
@@ -237,10 +238,34 @@ func (s *Server) CreateIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isAsync(r) {
+		s.SubmitJob(w, "create_index", key, &query)
+		return
+	}
+
+	if err := s.createIndex(key, &query, nil); err == errNoIndexItem {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		glog.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+var errNoIndexItem = errors.New("no item to index")
+
+func (s *Server) createIndex(key string, query *Query, h *jobHandle) error {
 	var index *lsh.Indexer
 	iter := s.Db.NewIterator(levelutil.BytesPrefix([]byte(key)), nil)
 	defer iter.Release()
 	for iter.Next() {
+		if h.Canceled() {
+			return errJobCanceled
+		}
+
 		item := ItemMeta{}
 
 		value := iter.Value()
@@ -255,18 +280,11 @@ func (s *Server) CreateIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if index == nil {
-		http.NotFound(w, r)
-		return
+		return errNoIndexItem
 	}
 
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	index.Encode(encoder)
-	if err := s.Db.Put([]byte(key+"_index"), buf.Bytes(), nil); err != nil {
-		glog.Error(err)
-		http.Error(w, "Error", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusCreated)
+	return s.Db.Put([]byte(key+"_index"), buf.Bytes(), nil)
 }
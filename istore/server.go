@@ -3,9 +3,13 @@ package istore
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image/color"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -25,12 +29,21 @@ import (
 const _PathIdSeq = "sys.seq"
 const _PathSeqNS = "sys.ns.seq"
 
+// _MaxRangeBuffer is the largest body to buffer to serve Range requests
+// when the origin does not support them.
+const _MaxRangeBuffer = 256 << 20
+
 type Server struct {
-	Client    *http.Client
-	Cache     httpcache.Cache
-	Db        *leveldb.DB
-	idseq     ItemId
-	idseqLock sync.RWMutex
+	Client *http.Client
+	Cache  httpcache.Cache
+	// Renditions caches the processed output, or nil to disable it.
+	Renditions *lru.Cache
+	Db         *leveldb.DB
+	S3         *S3Config
+	Blobs      *BlobStore
+	Jobs       *JobQueue
+	idseq      ItemId
+	idseqLock  sync.RWMutex
 }
 
 func copyHeader(w http.ResponseWriter, r *http.Response, header string) {
@@ -88,6 +101,46 @@ func parseSubValues(s string) Values {
 	return values
 }
 
+// formFloat parses the form value, or returns defval if not given.
+func formFloat(r *http.Request, name string, defval float64) (float64, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return defval, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, badRequest("invalid %s %q", name, v)
+	}
+	return f, nil
+}
+
+// formDimension parses the form value as a width or height up to
+// MaxDimension, or 0 if not given.
+func formDimension(r *http.Request, name string) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || (MaxDimension > 0 && n > MaxDimension) {
+		return 0, badRequest("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// formColor parses the form value as #rrggbb etc., or defval if not given.
+func formColor(r *http.Request, name string, defval string) (color.NRGBA, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		v = defval
+	}
+	c, err := parseColor(v)
+	if err != nil {
+		return c, badRequest("invalid %s %q", name, v)
+	}
+	return c, nil
+}
+
 func NewServer(dbfile string) *Server {
 	//cache := diskcache.NewWithDiskv(
 	//	diskv.New(diskv.Options{
@@ -113,15 +166,25 @@ func NewServer(dbfile string) *Server {
 		Client: cacheTransport.Client(),
 		Cache:  cache,
 		Db:     db,
+		S3:     NewS3ConfigFromEnv(),
+		Blobs:  NewBlobStore(dbfile + ".blobs"),
 		idseq:  ToItemId(idseq),
 	}
 	cacheTransport.Transport = s
+	if RenditionCacheSize > 0 {
+		s.Renditions = lru.New(RenditionCacheSize)
+	}
+	s.Jobs = NewJobQueue(s, JobWorkers)
 
 	return s
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("%s %s %s", r.Method, r.URL, r.Proto)
+	if strings.HasPrefix(r.URL.Path, "/_jobs/") {
+		s.ServeJobs(w, r)
+		return
+	}
 	switch r.Method {
 	case "POST", "PUT":
 		s.ServePost(w, r)
@@ -186,6 +249,13 @@ func (s *Server) PutObject(key []byte, value string, batch *leveldb.Batch, overw
 		}
 	}
 
+	// the technical metadata is maintained by _probe
+	probed, hasProbe := meta.MetaData[_MetaProbe]
+	delete(usermeta, _MetaProbe)
+	if hasProbe {
+		usermeta[_MetaProbe] = probed
+	}
+
 	meta.MetaData = usermeta
 
 	metabytes = []byte{}
@@ -231,6 +301,24 @@ func (s *Server) ServePost(w http.ResponseWriter, r *http.Request) {
 	} else if strings.HasSuffix(key, "/_expand") {
 		s.Expand(w, r)
 		return
+	} else if strings.HasSuffix(key, "/_upload") {
+		s.Upload(w, r)
+		return
+	} else if strings.HasSuffix(key, "/_verify") {
+		s.Verify(w, r)
+		return
+	} else if strings.HasSuffix(key, "/_probe") {
+		s.Probe(w, r)
+		return
+	} else if strings.HasSuffix(key, "/_batch_get") {
+		s.BatchGet(w, r)
+		return
+	} else if strings.HasSuffix(key, "/_warm") {
+		s.Warm(w, r)
+		return
+	} else if r.URL.Query().Get("apply") == "overlay" {
+		s.PostApply(w, r, "overlay")
+		return
 	}
 
 	// read user input metadata
@@ -252,6 +340,15 @@ func (s *Server) ServePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if v := r.FormValue("probe"); v != "" && v != "0" && v != "false" {
+		// the item stays registered even if the object cannot be probed
+		if _, err := s.probeItem(key); err != nil {
+			glog.Error(err)
+		} else if data, err := s.Db.Get([]byte(key), nil); err == nil {
+			metabytes = data
+		}
+	}
+
 	if isnew {
 		w.WriteHeader(http.StatusCreated)
 	} else {
@@ -324,6 +421,14 @@ func (s *Server) ServeGet(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
 	if strings.HasSuffix(path, "/") {
+		if r.FormValue("apply") == "contactsheet" {
+			s.ServeContactSheet(w, r, path)
+			return
+		}
+		if r.FormValue("archive") != "" {
+			s.ServeArchive(w, r, path)
+			return
+		}
 		s.ServeList(w, r, path)
 		return
 	} else if path == "/"+_PathSeqNS {
@@ -331,7 +436,8 @@ func (s *Server) ServeGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := s.Db.Get([]byte(path), nil); err != nil {
+	data, err := s.Db.Get([]byte(path), nil)
+	if err != nil {
 		if err == leveldb.ErrNotFound {
 			glog.Error(path, " not found")
 			http.NotFound(w, r)
@@ -345,24 +451,100 @@ func (s *Server) ServeGet(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := s.GetApply(r)
 	if err != nil {
-		statusCode := http.StatusInternalServerError
-		if resp == nil {
-		} else {
-			statusCode = resp.StatusCode
-		}
+		statusCode := errorStatus(err, resp)
 		glog.Error(err, statusCode)
+		setRetryAfter(w, statusCode)
 		http.Error(w, "Error", statusCode)
 		return
 	}
 
+	defer resp.Body.Close()
+
 	copyHeader(w, resp, "Last-Modified")
 	copyHeader(w, resp, "Expires")
 	copyHeader(w, resp, "Etag")
 	copyHeader(w, resp, "Content-Length")
 	copyHeader(w, resp, "Content-Type")
+	copyHeader(w, resp, "Cache-Control")
+	for _, header := range []string{
+		"X-Istore-Frame-Timestamp", "X-Istore-Clip-Start",
+		"X-Istore-Tensor-Shape", "X-Istore-Tensor-Dtype",
+	} {
+		copyHeader(w, resp, header)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	meta := ItemMeta{}
+	if _, err := meta.UnmarshalMsg(data); err != nil {
+		glog.Error("failed to unmarshal metadata from db ", err)
+	}
+	setContentHeaders(w, &meta)
+
+	if resp.StatusCode == http.StatusNotModified || notModified(r, w.Header()) {
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if r.Header.Get("Range") != "" {
+		serveRange(w, r, resp)
+		return
+	}
+
+	// Record the checksum of the source object on the first fetch.
+	if meta.Sha256 == "" && resp.StatusCode == http.StatusOK && r.FormValue("apply") == "" && r.FormValue("output") == "" {
+		hash := sha256.New()
+		size, err := io.Copy(w, io.TeeReader(resp.Body, hash))
+		if err == nil {
+			sum := hex.EncodeToString(hash.Sum(nil))
+			ctype := resp.Header.Get("Content-Type")
+			if err := s.recordContentInfo(path, sum, size, ctype); err != nil {
+				glog.Error(err)
+			}
+		}
+		return
+	}
 	io.Copy(w, resp.Body)
 }
 
+// serveRange responds to a Range request.  The partial content from the
+// origin is relayed as is.  Otherwise the ranges are cut from the body if it
+// is seekable (local files) or small enough to buffer in memory.
+func serveRange(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK {
+		// 206 Partial Content, 416 Requested Range Not Satisfiable, etc.
+		copyHeader(w, resp, "Content-Range")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	content, ok := resp.Body.(io.ReadSeeker)
+	if !ok {
+		if resp.ContentLength > _MaxRangeBuffer {
+			// ignore the range as HTTP allows
+			io.Copy(w, resp.Body)
+			return
+		}
+		buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, _MaxRangeBuffer+1))
+		if err != nil {
+			glog.Error(err)
+			http.Error(w, "Error", http.StatusInternalServerError)
+			return
+		}
+		if len(buf) > _MaxRangeBuffer {
+			io.Copy(w, io.MultiReader(bytes.NewReader(buf), resp.Body))
+			return
+		}
+		content = bytes.NewReader(buf)
+	}
+
+	// ServeContent computes Content-Length for each range
+	w.Header().Del("Content-Length")
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
 func (s *Server) GetApply(r *http.Request) (*http.Response, error) {
 	path := r.URL.Path
 
@@ -376,7 +558,25 @@ func (s *Server) GetApply(r *http.Request) (*http.Response, error) {
 		glog.Info("GetApply ", Url)
 	}
 
-	resp, err := s.Client.Get(Url)
+	if r.FormValue("apply") == "annotate" {
+		if err := s.setAnnotationOverlay(r); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("GET", Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := s.Client
+	if rangeSpec := r.Header.Get("Range"); rangeSpec != "" && r.FormValue("apply") == "" && r.FormValue("output") == "" {
+		// Ask the origin for the partial content.  This bypasses the cache
+		// as it would store the partial content as the whole object.
+		req.Header.Set("Range", rangeSpec)
+		client = &http.Client{Transport: s}
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		if resp != nil {
 			return resp, fmt.Errorf("remote URL %q returned status: %v\n%v", Url, resp.Status, err)
@@ -384,14 +584,53 @@ func (s *Server) GetApply(r *http.Request) (*http.Response, error) {
 		return resp, err
 	}
 
-	return handleApply(resp, r)
+	return s.cachedApply(Url, resp, r)
 }
 
 func handleApply(resp *http.Response, r *http.Request) (newresp *http.Response, err error) {
 	apply := r.FormValue("apply")
+	tensorOpts, err := parseTensorOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	if apply == "" && tensorOpts == nil {
+		return resp, nil
+	}
+	if tensorOpts != nil {
+		switch apply {
+		case "frame", "contactsheet", "preview", "clip", "transcode":
+			return nil, badRequest("output=%s is not supported by %s", tensorOpts.Format, apply)
+		}
+	}
+
+	cacheControl := cacheControlFor(apply)
+	etag := renditionETag(resp.Header, r)
+	if etag != "" {
+		validators := http.Header{
+			"Etag":          {etag},
+			"Last-Modified": resp.Header["Last-Modified"],
+		}
+		if notModified(r, validators) {
+			return notModifiedResponse(resp, r, etag, cacheControl)
+		}
+	}
+
+	if tensorOpts != nil {
+		data, err := losslessImage(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
 
 	var img []byte
 	switch apply {
+	case "":
+		// the tensor of the image as is
+		if img, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
 	case "adjustBrightness":
 		percentage, err := strconv.ParseFloat(r.FormValue("percentage"), 64)
 		if img, err = adjustBrightness(resp.Body, percentage); err != nil {
@@ -417,19 +656,65 @@ func handleApply(resp *http.Response, r *http.Request) (newresp *http.Response,
 			return nil, err
 		}
 
+	case "adjustHue":
+		shift, err := formFloat(r, "shift", 0)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = adjustHue(resp.Body, shift); err != nil {
+			return nil, err
+		}
+
+	case "adjustSaturation":
+		percentage, err := formFloat(r, "percentage", 0)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = adjustSaturation(resp.Body, percentage); err != nil {
+			return nil, err
+		}
+
+	case "autoorient":
+		if img, err = autoOrient(resp.Body); err != nil {
+			return nil, err
+		}
+
 	case "blur":
 		sigma, _ := strconv.ParseFloat(r.FormValue("sigma"), 64)
 		if img, err = blur(resp.Body, sigma); err != nil {
 			return nil, err
 		}
 
+	case "channel":
+		if img, err = channel(resp.Body, r.FormValue("c")); err != nil {
+			return nil, err
+		}
+
+	case "colorBalance":
+		var balance [3]float64
+		for i, name := range []string{"r", "g", "b"} {
+			if balance[i], err = formFloat(r, name, 0); err != nil {
+				return nil, err
+			}
+		}
+		if img, err = colorBalance(resp.Body, balance[0], balance[1], balance[2]); err != nil {
+			return nil, err
+		}
+
 	case "crop":
 		x1, err := strconv.Atoi(r.FormValue("x1"))
 		y1, err := strconv.Atoi(r.FormValue("y1"))
 		x2, err := strconv.Atoi(r.FormValue("x2"))
 		y2, err := strconv.Atoi(r.FormValue("y2"))
 		if x1 == 0 && y1 == 0 && x2 == 0 && y2 == 0 {
-			return resp, nil
+			if tensorOpts == nil {
+				return resp, nil
+			}
+			// the tensor of the image as is
+			if img, err = ioutil.ReadAll(resp.Body); err != nil {
+				return nil, err
+			}
+			break
 		}
 		if img, err = crop(resp.Body, x1, y1, x2, y2); err != nil {
 			return nil, err
@@ -457,10 +742,47 @@ func handleApply(resp *http.Response, r *http.Request) (newresp *http.Response,
 			}
 		}
 
+	case "overlay", "annotate":
+		shapes, err := parseOverlay(r.FormValue("overlay"))
+		if err != nil {
+			return nil, err
+		}
+		if img, err = overlay(resp.Body, shapes); err != nil {
+			return nil, err
+		}
+
+	case "equalize":
+		if img, err = equalize(resp.Body); err != nil {
+			return nil, err
+		}
+
 	case "fit":
-		w, err := strconv.Atoi(r.FormValue("w"))
-		h, err := strconv.Atoi(r.FormValue("h"))
-		if img, err = fit(resp.Body, w, h); err != nil {
+		opts, err := parseResizeOptions(r, true)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = fit(resp.Body, opts); err != nil {
+			return nil, err
+		}
+
+	case "fill", "smartcrop", "thumbnail":
+		w, err := formDimension(r, "w")
+		if err != nil {
+			return nil, err
+		}
+		h, err := formDimension(r, "h")
+		if err != nil {
+			return nil, err
+		}
+		anchor := r.FormValue("anchor")
+		if apply == "smartcrop" {
+			anchor = "smart"
+		}
+		filter, err := parseFilter(r.FormValue("filter"))
+		if err != nil {
+			return nil, err
+		}
+		if img, err = fill(resp.Body, w, h, anchor, filter); err != nil {
 			return nil, err
 		}
 
@@ -484,6 +806,56 @@ func handleApply(resp *http.Response, r *http.Request) (newresp *http.Response,
 			return nil, err
 		}
 
+	case "pad", "letterbox":
+		w, err := formDimension(r, "w")
+		if err != nil {
+			return nil, err
+		}
+		h, err := formDimension(r, "h")
+		if err != nil {
+			return nil, err
+		}
+		bg, err := formColor(r, "bg", "#000000")
+		if err != nil {
+			return nil, err
+		}
+		filter, err := parseFilter(r.FormValue("filter"))
+		if err != nil {
+			return nil, err
+		}
+		scale := apply == "letterbox"
+		if img, err = pad(resp.Body, w, h, r.FormValue("anchor"), bg, scale, filter); err != nil {
+			return nil, err
+		}
+
+	case "rotate":
+		angle, err := formFloat(r, "angle", 0)
+		if err != nil {
+			return nil, err
+		}
+		bg, err := formColor(r, "bg", "#00000000")
+		if err != nil {
+			return nil, err
+		}
+		if img, err = rotate(resp.Body, angle, bg); err != nil {
+			return nil, err
+		}
+
+	case "rotate90":
+		if img, err = rotate90(resp.Body); err != nil {
+			return nil, err
+		}
+
+	case "rotate180":
+		if img, err = rotate180(resp.Body); err != nil {
+			return nil, err
+		}
+
+	case "rotate270":
+		if img, err = rotate270(resp.Body); err != nil {
+			return nil, err
+		}
+
 	case "sharpen":
 		sigmoid, err := strconv.ParseFloat(r.FormValue("sigmoid"), 64)
 		if img, err = sharpen(resp.Body, sigmoid); err != nil {
@@ -501,43 +873,170 @@ func handleApply(resp *http.Response, r *http.Request) (newresp *http.Response,
 		}
 
 	case "resize":
-		w, err := strconv.Atoi(r.FormValue("w"))
-		h, err := strconv.Atoi(r.FormValue("h"))
-		if w == 0 && h == 0 {
-			return resp, nil
+		opts, err := parseResizeOptions(r, false)
+		if err != nil {
+			return nil, err
 		}
-		if img, err = resize(resp.Body, w, h); err != nil {
+		if opts.Width == 0 && opts.Height == 0 && opts.Percent == 0 &&
+			opts.MaxWidth == 0 && opts.MaxHeight == 0 {
+			if tensorOpts == nil {
+				return resp, nil
+			}
+			if img, err = ioutil.ReadAll(resp.Body); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if img, err = resize(resp.Body, opts); err != nil {
 			return nil, err
 		}
 
 	case "frame":
-		sec, err := strconv.Atoi(r.FormValue("sec"))
-		if img, err = frame(resp.Body, sec); err != nil {
+		opts := &frameOptions{N: -1}
+		if n, err := strconv.Atoi(r.FormValue("n")); err == nil {
+			if n < 0 {
+				return nil, fmt.Errorf("invalid frame index %d", n)
+			}
+			opts.N = n
+		} else if ms, err := strconv.ParseFloat(r.FormValue("ms"), 64); err == nil {
+			opts.Sec = ms / 1000
+		} else {
+			opts.Sec, _ = strconv.ParseFloat(r.FormValue("sec"), 64)
+		}
+		opts.Keyframe = r.FormValue("keyframe") == "nearest"
+
+		var ts float64
+		ctype := "image/jpeg"
+		body := bufio.NewReader(resp.Body)
+		if magic, _ := body.Peek(4); isGIF(magic) {
+			img, ts, err = gifFrame(body, opts)
+			ctype = "image/png"
+		} else {
+			img, ts, err = frame(body, opts)
+		}
+		if err != nil {
 			return nil, err
 		}
 
 		buf := new(bytes.Buffer)
 		fmt.Fprintf(buf, "%s %s\n", resp.Proto, resp.Status)
 		fmt.Fprintf(buf, "Content-Length: %d\n", len(img))
-		fmt.Fprintf(buf, "Content-type: image/jpeg\n\n")
+		fmt.Fprintf(buf, "X-Istore-Frame-Timestamp: %.6f\n", ts)
+		if etag != "" {
+			fmt.Fprintf(buf, "Etag: %s\n", etag)
+		}
+		fmt.Fprintf(buf, "Cache-Control: %s\n", cacheControl)
+		fmt.Fprintf(buf, "Content-type: %s\n\n", ctype)
 		buf.Write(img)
 
 		return http.ReadResponse(bufio.NewReader(buf), r)
 
+	case "contactsheet":
+		opts, err := parseContactSheetOptions(r)
+		if err != nil {
+			return nil, err
+		}
+		img, err = videoContactSheet(resp.Body, opts)
+		if err != nil {
+			return nil, err
+		}
+		resp.Header.Set("Content-Type", "image/jpeg")
+
+	case "preview":
+		opts, err := parsePreviewOptions(r)
+		if err != nil {
+			return nil, err
+		}
+
+		data, ctype, start, err := preview(resp.Body, opts)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		buf := new(bytes.Buffer)
+		fmt.Fprintf(buf, "%s %s\n", resp.Proto, resp.Status)
+		fmt.Fprintf(buf, "Content-Length: %d\n", len(data))
+		fmt.Fprintf(buf, "X-Istore-Frame-Timestamp: %.6f\n", start)
+		if etag != "" {
+			fmt.Fprintf(buf, "Etag: %s\n", etag)
+		}
+		fmt.Fprintf(buf, "Cache-Control: %s\n", cacheControl)
+		fmt.Fprintf(buf, "Content-type: %s\n\n", ctype)
+		buf.Write(data)
+
+		return http.ReadResponse(bufio.NewReader(buf), r)
+
+	case "clip", "transcode":
+		opts, err := parseTranscodeOptions(r, apply)
+		if err != nil {
+			return nil, err
+		}
+
+		key := transcodeCacheKey(r.URL.Path, resp.Header, opts)
+		result, err := cachedTranscode(key, resp.Body, opts)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// The output is streamed from the file, which may be larger than
+		// the memory.
+		header := http.Header{}
+		header.Set("Content-Length", strconv.FormatInt(result.Size, 10))
+		header.Set("X-Istore-Clip-Start", fmt.Sprintf("%.6f", result.Start))
+		if etag != "" {
+			header.Set("Etag", etag)
+		}
+		header.Set("Cache-Control", cacheControl)
+		header.Set("Content-Type", result.ContentType)
+		return &http.Response{
+			Status:        resp.Status,
+			StatusCode:    resp.StatusCode,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          result.Body,
+			ContentLength: result.Size,
+			Request:       r,
+		}, nil
+
 	default:
-		return resp, nil
+		if tensorOpts == nil {
+			return resp, nil
+		}
+		if img, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
 	}
 	defer resp.Body.Close()
 
+	if tensorOpts != nil {
+		data, shape, err := tensor(img, tensorOpts)
+		if err != nil {
+			return nil, err
+		}
+		img = data
+		resp.Header.Set("Content-Type", tensorOpts.contentType())
+		resp.Header.Set("X-Istore-Tensor-Shape", formatShape(shape))
+		resp.Header.Set("X-Istore-Tensor-Dtype", tensorOpts.DType)
+	}
+
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "%s %s\n", resp.Proto, resp.Status)
 	excludes := map[string]bool{
 		"Content-Length": true,
 		"Cache-Control":  true,
+		"Etag":           true,
+		"Date":           true,
 	}
 	resp.Header.WriteSubset(buf, excludes)
 	fmt.Fprintf(buf, "Date: %s\n", time.Now().Format(time.RFC1123))
-	fmt.Fprintf(buf, "Cache-Control: max-age=1000000\n")
+	if etag != "" {
+		fmt.Fprintf(buf, "Etag: %s\n", etag)
+	}
+	fmt.Fprintf(buf, "Cache-Control: %s\n", cacheControl)
 	fmt.Fprintf(buf, "Content-Length: %d\n\n", len(img))
 	buf.Write(img)
 
@@ -66,6 +66,39 @@ func (w *mockWriter) WriteHeader(status int) {
 	w.status = status
 }
 
+// testServer is the Server on a temporary directory.
+type testServer struct {
+	*Server
+	Dir string
+}
+
+func newTestServer() *testServer {
+	name, _ := ioutil.TempDir("", "istore")
+	return &testServer{
+		Server: NewServer(filepath.Join(name, "db")),
+		Dir:    name,
+	}
+}
+
+// request serves the request of the path, like "/path/to/file:///a.jpg".
+func (s *testServer) request(method, path, body string) *mockWriter {
+	r, _ := http.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+	return s.do(r)
+}
+
+// do serves the request made by the test, e.g. with headers.
+func (s *testServer) do(r *http.Request) *mockWriter {
+	w := newMockWriter()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// testdataFile returns the absolute path of the file in testdata.
+func testdataFile(name string) string {
+	wd, _ := os.Getwd()
+	return filepath.Join(wd, "testdata", name)
+}
+
 func sendForm(method, url string, data url.Values) (*http.Request, error) {
 	r, err := http.NewRequest(method, url, strings.NewReader(data.Encode()))
 	if err != nil {
@@ -0,0 +1,271 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// tensorChannels are the offsets in NRGBA of each channel order.  gray is
+// the luma.
+var tensorChannels = map[string][]int{
+	"rgb":  {0, 1, 2},
+	"bgr":  {2, 1, 0},
+	"rgba": {0, 1, 2, 3},
+	"bgra": {2, 1, 0, 3},
+	"gray": {-1},
+}
+
+// tensorOptions describe the pixels output by output=npy or output=raw.
+type tensorOptions struct {
+	// Format is "npy" for NumPy .npy, or "raw" for the bare values.
+	Format string
+	// DType is "uint8" or "float32".  float32 values are in 0.0 - 1.0
+	// before normalization.
+	DType string
+	// Layout is "hwc" or "chw".
+	Layout string
+	// Channels is the channel order: rgb, bgr, rgba, bgra or gray.
+	Channels string
+	// Mean and Std normalize float32 values as (v - mean) / std, one for
+	// each channel.
+	Mean, Std []float64
+}
+
+func parseFloatList(s string) ([]float64, error) {
+	values := []float64{}
+	for _, v := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, f)
+	}
+	return values, nil
+}
+
+// parseTensorOptions reads output, dtype, layout, channels, mean and std.
+// It returns nil if the output is not a tensor.
+func parseTensorOptions(r *http.Request) (*tensorOptions, error) {
+	opts := &tensorOptions{
+		Format:   r.FormValue("output"),
+		DType:    r.FormValue("dtype"),
+		Layout:   r.FormValue("layout"),
+		Channels: r.FormValue("channels"),
+	}
+	switch opts.Format {
+	case "":
+		return nil, nil
+	case "npy", "raw":
+	default:
+		return nil, badRequest("unknown output %q", opts.Format)
+	}
+
+	if opts.Layout == "" {
+		opts.Layout = "hwc"
+	}
+	if opts.Layout != "hwc" && opts.Layout != "chw" {
+		return nil, badRequest("unknown layout %q", opts.Layout)
+	}
+	if opts.Channels == "" {
+		opts.Channels = "rgb"
+	}
+	channels, ok := tensorChannels[opts.Channels]
+	if !ok {
+		return nil, badRequest("unknown channels %q", opts.Channels)
+	}
+
+	normalize := map[string]*[]float64{"mean": &opts.Mean, "std": &opts.Std}
+	for name, values := range normalize {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		list, err := parseFloatList(v)
+		if err != nil {
+			return nil, badRequest("invalid %s %q", name, v)
+		}
+		if len(list) == 1 {
+			// the same for all channels
+			for len(list) < len(channels) {
+				list = append(list, list[0])
+			}
+		}
+		if len(list) != len(channels) {
+			return nil, badRequest("%s %q should have %d values", name, v, len(channels))
+		}
+		*values = list
+	}
+	for _, std := range opts.Std {
+		if std == 0 {
+			return nil, badRequest("std should not be 0")
+		}
+	}
+
+	normalized := opts.Mean != nil || opts.Std != nil
+	switch opts.DType {
+	case "":
+		opts.DType = "uint8"
+		if normalized {
+			opts.DType = "float32"
+		}
+	case "uint8":
+		if normalized {
+			return nil, badRequest("mean and std need dtype float32")
+		}
+	case "float32":
+	default:
+		return nil, badRequest("unknown dtype %q", opts.DType)
+	}
+	return opts, nil
+}
+
+// shape returns the dimensions of the tensor of the image size.
+func (opts *tensorOptions) shape(size image.Point) []int {
+	c := len(tensorChannels[opts.Channels])
+	if opts.Layout == "chw" {
+		return []int{c, size.Y, size.X}
+	}
+	return []int{size.Y, size.X, c}
+}
+
+func (opts *tensorOptions) contentType() string {
+	if opts.Format == "npy" {
+		return "application/x-npy"
+	}
+	return "application/octet-stream"
+}
+
+func formatShape(shape []int) string {
+	dims := make([]string, len(shape))
+	for i, n := range shape {
+		dims[i] = strconv.Itoa(n)
+	}
+	return strings.Join(dims, ",")
+}
+
+// npyHeader returns the header of .npy version 1.0 for the C order array.
+func npyHeader(dtype string, shape []int) []byte {
+	descr := "|u1"
+	if dtype == "float32" {
+		descr = "<f4"
+	}
+	dict := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }",
+		descr, strings.Replace(formatShape(shape), ",", ", ", -1))
+
+	// The data starts at a multiple of 64 bytes, after the newline.
+	const prefix = 10
+	padding := 63 - (prefix+len(dict))%64
+	dict += strings.Repeat(" ", padding) + "\n"
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(buf, binary.LittleEndian, uint16(len(dict)))
+	buf.WriteString(dict)
+	return buf.Bytes()
+}
+
+// tensorData returns the pixel values of m in the layout of the options.
+func tensorData(m image.Image, opts *tensorOptions) []byte {
+	src := imaging.Clone(m)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	channels := tensorChannels[opts.Channels]
+	c := len(channels)
+
+	size := 1
+	if opts.DType == "float32" {
+		size = 4
+	}
+	data := make([]byte, w*h*c*size)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := src.Pix[y*src.Stride+x*4 : y*src.Stride+x*4+4]
+			for k, offset := range channels {
+				var v uint8
+				if offset < 0 {
+					v, _, _ = color.RGBToYCbCr(p[0], p[1], p[2])
+				} else {
+					v = p[offset]
+				}
+
+				i := (y*w+x)*c + k
+				if opts.Layout == "chw" {
+					i = k*w*h + y*w + x
+				}
+				if size == 1 {
+					data[i] = v
+					continue
+				}
+				f := float64(v) / 255
+				if opts.Mean != nil {
+					f -= opts.Mean[k]
+				}
+				if opts.Std != nil {
+					f /= opts.Std[k]
+				}
+				binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(float32(f)))
+			}
+		}
+	}
+	return data
+}
+
+// losslessImage decodes the image and encodes it in PNG, so that the
+// operation before the tensor output doesn't lose the precision by JPEG.
+func losslessImage(input io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	_, release, err := acquireImage(data, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	m, _, err := decodeImage(bytes.NewReader(data), AutoOrient)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tensor converts the image to the tensor, and returns its shape.
+func tensor(input []byte, opts *tensorOptions) ([]byte, []int, error) {
+	config, err := checkImage(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	// float32 of each channel is 4 times as large as the image
+	release, err := processing.acquire(imageMemory(config.Width, config.Height, 4))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	m, _, err := image.Decode(bytes.NewReader(input))
+	if err != nil {
+		return nil, nil, err
+	}
+	shape := opts.shape(m.Bounds().Size())
+	data := tensorData(m, opts)
+	if opts.Format == "npy" {
+		data = append(npyHeader(opts.DType, shape), data...)
+	}
+	return data, shape, nil
+}
@@ -0,0 +1,95 @@
+package istore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestTensorData(c *C) {
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	m.Set(0, 0, color.NRGBA{10, 20, 30, 255})
+	m.Set(1, 0, color.NRGBA{40, 50, 60, 255})
+
+	opts := &tensorOptions{Format: "raw", DType: "uint8", Layout: "hwc", Channels: "rgb"}
+	c.Check(tensorData(m, opts), DeepEquals, []byte{10, 20, 30, 40, 50, 60})
+	c.Check(opts.shape(m.Bounds().Size()), DeepEquals, []int{1, 2, 3})
+
+	opts.Layout, opts.Channels = "chw", "bgr"
+	c.Check(tensorData(m, opts), DeepEquals, []byte{30, 60, 20, 50, 10, 40})
+	c.Check(opts.shape(m.Bounds().Size()), DeepEquals, []int{3, 1, 2})
+
+	opts.DType, opts.Mean, opts.Std = "float32", []float64{0.5, 0.5, 0.5}, []float64{0.5, 0.5, 0.5}
+	data := tensorData(m, opts)
+	c.Assert(len(data), Equals, 24)
+	v := math.Float32frombits(binary.LittleEndian.Uint32(data))
+	c.Check(math.Abs(float64(v)-(30.0/255-0.5)/0.5) < 1e-6, Equals, true)
+
+	header := npyHeader("float32", []int{3, 1, 2})
+	c.Check(len(header)%64, Equals, 0)
+	c.Check(string(header[:8]), Equals, "\x93NUMPY\x01\x00")
+	c.Check(bytes.Contains(header, []byte("{'descr': '<f4', 'fortran_order': False, 'shape': (3, 1, 2), }")), Equals, true)
+	c.Check(header[len(header)-1], Equals, byte('\n'))
+}
+
+func (_ *S) TestTensorOutput(c *C) {
+	server := newTestServer()
+
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range src.Pix {
+		src.Pix[i] = 255
+	}
+	testdata := filepath.Join(server.Dir, "white.png")
+	f, _ := os.Create(testdata)
+	png.Encode(f, src)
+	f.Close()
+
+	server.request("POST", "/path/tensor/file://"+testdata, "")
+
+	mock := server.request("GET", "/path/tensor/file://"+testdata+"?apply=resize&w=2&output=npy&layout=chw&mean=0.5&std=0.25", "")
+	c.Check(mock.status, Equals, http.StatusOK)
+	c.Check(mock.header.Get("Content-Type"), Equals, "application/x-npy")
+	c.Check(mock.header.Get("X-Istore-Tensor-Shape"), Equals, "3,1,2")
+	c.Check(mock.header.Get("X-Istore-Tensor-Dtype"), Equals, "float32")
+	body := mock.body.Bytes()
+	c.Assert(len(body), Equals, 64+3*1*2*4)
+	c.Check(math.Float32frombits(binary.LittleEndian.Uint32(body[64:])), Equals, float32(2))
+
+	// the tensor of the image as is if apply does nothing
+	for _, apply := range []string{"resize", "crop", "unknown"} {
+		mock = server.request("GET", "/path/tensor/file://"+testdata+"?apply="+apply+"&output=npy", "")
+		c.Check(mock.status, Equals, http.StatusOK, Commentf(apply))
+		c.Check(mock.header.Get("Content-Type"), Equals, "application/x-npy", Commentf(apply))
+		c.Check(mock.header.Get("X-Istore-Tensor-Shape"), Equals, "2,4,3", Commentf(apply))
+		c.Check(mock.header.Get("Content-Length"), Equals, strconv.Itoa(mock.body.Len()), Commentf(apply))
+		c.Check(mock.body.Len() > 2*4*3*4, Equals, true, Commentf(apply))
+	}
+
+	// without apply
+	mock = server.request("GET", "/path/tensor/file://"+testdata+"?output=raw&channels=gray", "")
+	c.Check(mock.header.Get("X-Istore-Tensor-Shape"), Equals, "2,4,1")
+	c.Check(mock.body.Bytes(), DeepEquals, bytes.Repeat([]byte{255}, 8))
+
+	for _, query := range []string{
+		"output=raw&dtype=uint8&mean=0.5",
+		"output=bmp",
+		"output=npy&layout=whc",
+		"output=npy&channels=cmyk",
+		"output=npy&std=0",
+		"output=npy&mean=1,2",
+		"output=npy&dtype=int64",
+		"output=npy&apply=frame",
+	} {
+		mock = server.request("GET", "/path/tensor/file://"+testdata+"?"+query, "")
+		c.Check(mock.status, Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
@@ -0,0 +1,727 @@
+package istore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/umitanuki/gmf"
+)
+
+type containerInfo struct {
+	Muxer       string
+	ContentType string
+	// VideoCodec is the default encoder for transcode.
+	VideoCodec string
+}
+
+// containers are the output containers of clip and transcode, by the name
+// of containerFormat.
+var containers = map[string]containerInfo{
+	"mp4":      {"mp4", "video/mp4", "mpeg4"},
+	"mov":      {"mov", "video/quicktime", "mpeg4"},
+	"webm":     {"webm", "video/webm", "libvpx"},
+	"matroska": {"matroska", "video/x-matroska", "mpeg4"},
+	"avi":      {"avi", "video/x-msvideo", "mpeg4"},
+	"flv":      {"flv", "video/x-flv", "flv"},
+	"ogg":      {"ogg", "video/ogg", "libtheora"},
+	"mpeg":     {"mpeg", "video/mpeg", "mpeg1video"},
+	"mpegts":   {"mpegts", "video/mp2t", "mpeg2video"},
+}
+
+type transcodeOptions struct {
+	// Start and End limit the range in seconds.  End is unlimited if 0.
+	Start float64
+	End   float64
+	// Container is the output container, the same as input by default.
+	Container string
+	// Transcode re-encodes the video stream.  Otherwise packets are copied.
+	Transcode  bool
+	VideoCodec string
+	// Width and Height of the output.  The aspect ratio is kept if either
+	// of them is 0.
+	Width   int
+	Height  int
+	BitRate int
+	// NoAudio drops the audio streams.
+	NoAudio bool
+}
+
+// parseTranscodeOptions parses the args of apply, clip or transcode.
+func parseTranscodeOptions(r *http.Request, apply string) (*transcodeOptions, error) {
+	opts := &transcodeOptions{
+		Transcode:  apply == "transcode",
+		Container:  r.FormValue("format"),
+		VideoCodec: r.FormValue("vcodec"),
+		NoAudio:    r.FormValue("audio") == "none",
+	}
+	if _, ok := containers[opts.Container]; opts.Container != "" && !ok {
+		return nil, badRequest("unknown container %s", opts.Container)
+	}
+	for name, value := range map[string]*float64{"start": &opts.Start, "end": &opts.End} {
+		if v := r.FormValue(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, badRequest("invalid %s %q", name, v)
+			}
+			*value = f
+		}
+	}
+	var err error
+	if opts.Width, err = formDimension(r, "w"); err != nil {
+		return nil, err
+	}
+	if opts.Height, err = formDimension(r, "h"); err != nil {
+		return nil, err
+	}
+	if v := r.FormValue("bitrate"); v != "" {
+		if opts.BitRate, err = strconv.Atoi(v); err != nil {
+			return nil, badRequest("invalid bitrate %q", v)
+		}
+	}
+	// written to fail with NaN
+	if !(opts.Start >= 0) || math.IsInf(opts.Start, 1) || !(opts.End >= 0) ||
+		(opts.End > 0 && opts.End <= opts.Start) || opts.BitRate < 0 {
+		return nil, badRequest("invalid range of args for %s", apply)
+	}
+	return opts, nil
+}
+
+// TranscodeCacheDir is the directory to cache the output of clip and
+// transcode.  "" disables the cache.
+var TranscodeCacheDir = filepath.Join(os.TempDir(), "istore-transcode")
+
+// TranscodeCacheSize is the size in bytes of the output to keep in
+// TranscodeCacheDir.  The least recently used output is removed first.
+var TranscodeCacheSize int64 = 4 << 30
+
+// transcodeResult is the output of transcode.
+type transcodeResult struct {
+	ContentType string `json:"content_type"`
+	// Start is the actual start of the output in seconds of the input.
+	// Without re-encoding, it is the keyframe at or before the start.
+	Start float64 `json:"start"`
+	// Body reads the output of Size bytes.
+	Body io.ReadCloser `json:"-"`
+	Size int64         `json:"-"`
+	// file is the output, removed when Body is closed unless cached.
+	file string
+}
+
+type outputStream struct {
+	ist *gmf.Stream
+	ost *gmf.Stream
+	// encoder, sws and frame are set if the stream is re-encoded.
+	encoder *gmf.CodecCtx
+	sws     *gmf.SwsCtx
+	frame   *gmf.Frame
+	lastPts int
+}
+
+type transcoder struct {
+	ictx *gmf.FmtCtx
+	octx *gmf.FmtCtx
+	opts *transcodeOptions
+	// ref is the input stream to decide the range, video if any.
+	ref     *gmf.Stream
+	streams map[int]*outputStream
+	// offset is the input time of the output start, once decided.
+	offset    float64
+	hasOffset bool
+	decoders  []*gmf.CodecCtx
+	// release frees the processing limiter for re-encoding.
+	release func()
+}
+
+// evenSize returns the output size keeping the aspect ratio, rounded to
+// even numbers which most encoders require.
+func evenSize(width, height, srcWidth, srcHeight int) (int, int) {
+	switch {
+	case width == 0 && height == 0:
+		width, height = srcWidth, srcHeight
+	case width == 0:
+		width = int(float64(srcWidth*height)/float64(srcHeight) + 0.5)
+	case height == 0:
+		height = int(float64(srcHeight*width)/float64(srcWidth) + 0.5)
+	}
+	return width &^ 1, height &^ 1
+}
+
+func (t *transcoder) addEncodedStream(ist *gmf.Stream, icc *gmf.CodecCtx) error {
+	width, height := evenSize(t.opts.Width, t.opts.Height, icc.Width(), icc.Height())
+	if err := checkPixels(icc.Width(), icc.Height()); err != nil {
+		return err
+	}
+	if err := checkPixels(width, height); err != nil {
+		return err
+	}
+	// the decoded and the scaled frames, and the buffers of the encoder
+	release, err := processing.acquire(imageMemory(icc.Width(), icc.Height(), 1) + imageMemory(width, height, 1))
+	if err != nil {
+		return err
+	}
+	t.release = release
+
+	name := t.opts.VideoCodec
+	codec, err := gmf.FindEncoder(name)
+	if err != nil {
+		return err
+	}
+
+	ost := t.octx.NewStream(codec)
+	if ost == nil {
+		return fmt.Errorf("unable to create stream for %s", name)
+	}
+
+	enc := gmf.NewCodecCtx(codec)
+	if t.octx.IsGlobalHeader() {
+		enc.SetFlag(gmf.CODEC_FLAG_GLOBAL_HEADER)
+	}
+	if codec.IsExperimental() {
+		enc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
+	}
+	fps := 25
+	if d := frameDuration(ist); d > 0 {
+		fps = int(1/d + 0.5)
+	}
+	enc.SetTimeBase(gmf.AVR{Num: 1, Den: fps}).
+		SetDimension(width, height).
+		SetPixFmt(gmf.AV_PIX_FMT_YUV420P)
+	if t.opts.BitRate > 0 {
+		enc.SetBitRate(t.opts.BitRate)
+	}
+	if err := enc.Open(nil); err != nil {
+		gmf.Release(enc)
+		return err
+	}
+	ost.SetCodecCtx(enc)
+
+	frame := gmf.NewFrame().
+		SetWidth(width).
+		SetHeight(height).
+		SetFormat(gmf.AV_PIX_FMT_YUV420P)
+	if err := frame.ImgAlloc(); err != nil {
+		return err
+	}
+
+	t.streams[ist.Index()] = &outputStream{
+		ist:     ist,
+		ost:     ost,
+		encoder: enc,
+		sws:     gmf.NewSwsCtx(icc, enc, gmf.SWS_BICUBIC),
+		frame:   frame,
+		lastPts: -1,
+	}
+	return nil
+}
+
+func (t *transcoder) addStreams() error {
+	if ref, err := t.ictx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO); err == nil {
+		t.ref = ref
+	} else if ref, err := t.ictx.GetBestStream(gmf.AVMEDIA_TYPE_AUDIO); err == nil {
+		t.ref = ref
+	} else {
+		return fmt.Errorf("no video or audio stream")
+	}
+
+	for i := 0; i < t.ictx.StreamsCnt(); i++ {
+		ist, err := t.ictx.GetStream(i)
+		if err != nil {
+			return err
+		}
+		icc := streamCodecCtx(ist)
+		if icc == nil {
+			continue
+		}
+		t.decoders = append(t.decoders, icc)
+
+		switch icc.Type() {
+		case gmf.AVMEDIA_TYPE_VIDEO:
+			if ist.Index() != t.ref.Index() {
+				// the best video stream only
+				continue
+			}
+			if t.opts.Transcode {
+				if err := t.addEncodedStream(ist, icc); err != nil {
+					return err
+				}
+				continue
+			}
+		case gmf.AVMEDIA_TYPE_AUDIO:
+			if t.opts.NoAudio {
+				continue
+			}
+		default:
+			continue
+		}
+
+		ost, err := t.octx.AddStreamWithCodeCtx(icc)
+		if err != nil {
+			return err
+		}
+		t.streams[ist.Index()] = &outputStream{ist: ist, ost: ost}
+	}
+	return nil
+}
+
+func (t *transcoder) setOffset(sec float64) {
+	if !t.hasOffset {
+		t.offset = sec
+		t.hasOffset = true
+	}
+}
+
+// shift converts the input timestamp to the output timestamp.
+func (t *transcoder) shift(s *outputStream, ts int) int {
+	if ts == gmf.AV_NOPTS_VALUE {
+		return ts
+	}
+	ts -= streamTs(t.ictx, s.ist, t.offset)
+	return gmf.RescaleQ(ts, s.ist.TimeBase(), s.ost.TimeBase())
+}
+
+func (t *transcoder) copyPacket(s *outputStream, packet *gmf.Packet) error {
+	packet.SetPts(t.shift(s, packet.Pts()))
+	packet.SetDts(t.shift(s, packet.Dts()))
+	packet.SetDuration(gmf.RescaleQ(packet.Duration(), s.ist.TimeBase(), s.ost.TimeBase()))
+	packet.SetStreamIndex(s.ost.Index())
+	return t.octx.WritePacket(packet)
+}
+
+func (t *transcoder) writeEncoded(s *outputStream, p *gmf.Packet) error {
+	if p.Pts() != gmf.AV_NOPTS_VALUE {
+		p.SetPts(gmf.RescaleQ(p.Pts(), s.encoder.TimeBase(), s.ost.TimeBase()))
+	}
+	if p.Dts() != gmf.AV_NOPTS_VALUE {
+		p.SetDts(gmf.RescaleQ(p.Dts(), s.encoder.TimeBase(), s.ost.TimeBase()))
+	}
+	p.SetStreamIndex(s.ost.Index())
+	return t.octx.WritePacket(p)
+}
+
+// encodePacket decodes the packet and encodes frames in the range.  It
+// returns true after the end.
+func (t *transcoder) encodePacket(s *outputStream, packet *gmf.Packet) (bool, error) {
+	fps := float64(s.encoder.TimeBase().AVR().Den) / float64(s.encoder.TimeBase().AVR().Num)
+	for {
+		frame, err := packet.GetNextFrame(s.ist.CodecCtx())
+		if frame == nil || err != nil {
+			return false, err
+		}
+		sec := streamSeconds(t.ictx, s.ist, frame.TimeStamp())
+		if sec < t.opts.Start {
+			gmf.Release(frame)
+			continue
+		}
+		if t.opts.End > 0 && sec > t.opts.End {
+			gmf.Release(frame)
+			return true, nil
+		}
+
+		s.sws.Scale(frame, s.frame)
+		gmf.Release(frame)
+
+		pts := int(math.Floor((sec-t.offset)*fps + 0.5))
+		if pts <= s.lastPts {
+			pts = s.lastPts + 1
+		}
+		s.lastPts = pts
+		s.frame.SetPts(pts)
+
+		p, ready, err := s.frame.EncodeNewPacket(s.encoder)
+		if err != nil {
+			return false, err
+		}
+		if ready {
+			err = t.writeEncoded(s, p)
+		}
+		if p != nil {
+			gmf.Release(p)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func (t *transcoder) flush() error {
+	for _, s := range t.streams {
+		if s.encoder == nil {
+			continue
+		}
+		frame := gmf.NewFrame()
+		for {
+			p, ready, err := frame.FlushNewPacket(s.encoder)
+			if err != nil || !ready {
+				if p != nil {
+					gmf.Release(p)
+				}
+				break
+			}
+			err = t.writeEncoded(s, p)
+			gmf.Release(p)
+			if err != nil {
+				gmf.Release(frame)
+				return err
+			}
+		}
+		gmf.Release(frame)
+	}
+	return nil
+}
+
+func (t *transcoder) run() error {
+	if t.opts.Start > 0 {
+		seekStream(t.ictx, t.ref, t.opts.Start)
+	}
+	if t.opts.Transcode {
+		// frames are cut at the exact time
+		t.setOffset(t.opts.Start)
+	}
+
+	for {
+		packet := t.ictx.GetNextPacket()
+		if packet == nil {
+			break
+		}
+		done, err := func(packet *gmf.Packet) (bool, error) {
+			defer gmf.Release(packet)
+
+			s, ok := t.streams[packet.StreamIndex()]
+			if !ok {
+				return false, nil
+			}
+			if s.encoder != nil {
+				return t.encodePacket(s, packet)
+			}
+
+			ts := packet.Dts()
+			if ts == gmf.AV_NOPTS_VALUE {
+				ts = packet.Pts()
+			}
+			if ts == gmf.AV_NOPTS_VALUE {
+				return false, nil
+			}
+			sec := streamSeconds(t.ictx, s.ist, ts)
+			isRef := s.ist.Index() == t.ref.Index()
+			if isRef {
+				// start from the keyframe we seeked to
+				t.setOffset(sec)
+			}
+			if !t.hasOffset || sec < t.offset {
+				return false, nil
+			}
+			if t.opts.End > 0 && sec > t.opts.End {
+				return isRef, nil
+			}
+			return false, t.copyPacket(s, packet)
+		}(packet)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+
+	return t.flush()
+}
+
+func (t *transcoder) close() {
+	for _, s := range t.streams {
+		if s.encoder != nil {
+			gmf.Release(s.frame)
+			gmf.Release(s.sws)
+			// the output context frees the encoder
+			s.encoder.Close()
+		}
+	}
+	// This is necessary to avoid leaking thread used by codec.
+	for _, cc := range t.decoders {
+		cc.Close()
+	}
+	if t.release != nil {
+		t.release()
+	}
+}
+
+// transcode cuts the range of the video, and re-encodes the video stream if
+// opts.Transcode is set.  The output is written to a temporary file, as
+// gmf doesn't support writing to custom IO.
+func transcode(input io.Reader, opts *transcodeOptions) (*transcodeResult, error) {
+	body := bufio.NewReaderSize(input, 512)
+	magic, _ := body.Peek(512)
+	name := opts.Container
+	if name == "" {
+		if name = containerFormat(magic); name == "" {
+			name = "matroska"
+		}
+	}
+	container, ok := containers[name]
+	if !ok {
+		return nil, badRequest("unknown container %s", name)
+	}
+	if opts.Transcode && opts.VideoCodec == "" {
+		opts.VideoCodec = container.VideoCodec
+	}
+
+	if TranscodeCacheDir != "" {
+		// in the same directory to move into the cache
+		if err := os.MkdirAll(TranscodeCacheDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	tmpfile, err := ioutil.TempFile(TranscodeCacheDir, "istore-transcode")
+	if err != nil {
+		return nil, err
+	}
+	tmpfile.Close()
+
+	ictx, ioctx, err := openInput(body)
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return nil, err
+	}
+	defer func() {
+		gmf.Release(ioctx)
+		ictx.CloseInputAndRelease()
+	}()
+
+	octx, err := gmf.NewOutputCtxWithFormatName(tmpfile.Name(), container.Muxer)
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return nil, err
+	}
+
+	t := &transcoder{
+		ictx:    ictx,
+		octx:    octx,
+		opts:    opts,
+		streams: map[int]*outputStream{},
+	}
+
+	err = t.addStreams()
+	if err == nil {
+		err = octx.WriteHeader()
+	}
+	if err == nil {
+		err = t.run()
+		// Closing encoders frees the extradata which the trailer may refer
+		// to, so keep the context until then.
+		gmf.Retain(octx)
+		octx.CloseOutputAndRelease()
+	}
+	t.close()
+	gmf.Release(octx)
+	if err != nil {
+		glog.Error(err)
+		os.Remove(tmpfile.Name())
+		return nil, err
+	}
+
+	return &transcodeResult{
+		ContentType: container.ContentType,
+		Start:       t.offset,
+		file:        tmpfile.Name(),
+	}, nil
+}
+
+// transcodedBody reads the output file, and removes it on close unless it
+// is cached.
+type transcodedBody struct {
+	*os.File
+	remove bool
+}
+
+func (b *transcodedBody) Close() error {
+	err := b.File.Close()
+	if b.remove {
+		os.Remove(b.Name())
+	}
+	return err
+}
+
+// open sets Body to read the output file.
+func (result *transcodeResult) open(remove bool) error {
+	f, err := os.Open(result.file)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	result.Body = &transcodedBody{File: f, remove: remove}
+	result.Size = fi.Size()
+	return nil
+}
+
+// transcodeCacheMu serializes the eviction of the cache.
+var transcodeCacheMu sync.Mutex
+
+// transcodeCacheKey identifies the output by the item, the validator of
+// the source and the options.  It returns "" if the source has no
+// validator, as the output can't be told stale then, or the cache is
+// disabled.
+func transcodeCacheKey(path string, source http.Header, opts *transcodeOptions) string {
+	if TranscodeCacheDir == "" || TranscodeCacheSize <= 0 {
+		return ""
+	}
+	validator := source.Get("Etag")
+	if validator == "" {
+		validator = source.Get("Last-Modified")
+	}
+	if validator == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%+v", path, validator, *opts)))
+	return hex.EncodeToString(hash[:])
+}
+
+// cachedTranscode returns the output of the key from the cache, or
+// transcodes the input and caches the output.  The output isn't cached if
+// key is "".  Body of the result must be closed.
+func cachedTranscode(key string, input io.Reader, opts *transcodeOptions) (*transcodeResult, error) {
+	if result := openTranscoded(key); result != nil {
+		return result, nil
+	}
+
+	result, err := transcode(input, opts)
+	if err != nil {
+		return nil, err
+	}
+	cached := false
+	if key != "" {
+		if err := storeTranscoded(key, result); err != nil {
+			glog.Error("failed to cache the transcoded output ", err)
+		} else {
+			cached = true
+		}
+	}
+	if err := result.open(!cached); err != nil {
+		if !cached {
+			os.Remove(result.file)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// openTranscoded returns the cached output of the key, or nil.
+func openTranscoded(key string) *transcodeResult {
+	if key == "" {
+		return nil
+	}
+	name := filepath.Join(TranscodeCacheDir, key)
+	data, err := ioutil.ReadFile(name + ".json")
+	if err != nil {
+		return nil
+	}
+	result := &transcodeResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil
+	}
+	result.file = name
+	if err := result.open(false); err != nil {
+		return nil
+	}
+	// the modification time tells the last use to evict
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return result
+}
+
+// storeTranscoded moves the output file into the cache, and evicts the
+// least recently used output over TranscodeCacheSize.
+func storeTranscoded(key string, result *transcodeResult) error {
+	name := filepath.Join(TranscodeCacheDir, key)
+	if err := os.Rename(result.file, name); err != nil {
+		return err
+	}
+	result.file = name
+
+	// The metadata is written last, as it tells the output is complete.
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(TranscodeCacheDir, "istore-transcode")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(data)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), name+".json")
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	evictTranscoded()
+	return nil
+}
+
+type cachedOutput struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+type cachedOutputs []cachedOutput
+
+func (c cachedOutputs) Len() int           { return len(c) }
+func (c cachedOutputs) Less(i, j int) bool { return c[i].modTime.Before(c[j].modTime) }
+func (c cachedOutputs) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// evictTranscoded removes the least recently used output until the cache
+// fits in TranscodeCacheSize.  Open outputs are still read to the end.
+func evictTranscoded() {
+	transcodeCacheMu.Lock()
+	defer transcodeCacheMu.Unlock()
+
+	metas, err := filepath.Glob(filepath.Join(TranscodeCacheDir, "*.json"))
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	var outputs cachedOutputs
+	var total int64
+	for _, meta := range metas {
+		name := strings.TrimSuffix(meta, ".json")
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		outputs = append(outputs, cachedOutput{name, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	sort.Sort(outputs)
+	for _, output := range outputs {
+		if total <= TranscodeCacheSize {
+			break
+		}
+		// the metadata first not to be found without the output
+		os.Remove(output.name + ".json")
+		os.Remove(output.name)
+		total -= output.size
+	}
+}
@@ -0,0 +1,94 @@
+package istore
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	. "gopkg.in/check.v1"
+)
+
+func (_ *S) TestEvenSize(c *C) {
+	check := func(w, h, srcW, srcH, expectedW, expectedH int) {
+		width, height := evenSize(w, h, srcW, srcH)
+		c.Check(width, Equals, expectedW)
+		c.Check(height, Equals, expectedH)
+	}
+	check(0, 0, 1920, 1080, 1920, 1080)
+	check(640, 0, 1920, 1080, 640, 360)
+	check(0, 240, 1920, 1080, 426, 240)
+	check(0, 0, 641, 361, 640, 360)
+}
+
+func (_ *S) TestClip(c *C) {
+	server := newTestServer()
+	defer func(dir string) { TranscodeCacheDir = dir }(TranscodeCacheDir)
+	TranscodeCacheDir = filepath.Join(server.Dir, "transcode")
+	video := "/path/video/file://" + testdataFile("sample.avi")
+	server.request("POST", video, "")
+
+	// every frame is keyframe, so the clip starts at the exact time
+	mock := server.request("GET", video+"?apply=clip&start=0.4&end=1.2", "")
+	c.Assert(mock.status, Equals, http.StatusOK)
+	c.Check(mock.header.Get("Content-Type"), Equals, "video/x-msvideo")
+	c.Check(mock.header.Get("Content-Length"), Equals, strconv.Itoa(mock.body.Len()))
+	c.Check(mock.header.Get("X-Istore-Clip-Start"), Equals, "0.400000")
+	info, err := probe(bytes.NewReader(mock.body.Bytes()))
+	c.Assert(err, IsNil)
+	c.Check(info["width"], Equals, int64(64))
+	c.Check(info["duration"].(float64) < 1.0, Equals, true)
+
+	// served from the cache
+	metas, _ := filepath.Glob(filepath.Join(TranscodeCacheDir, "*.json"))
+	c.Check(len(metas), Equals, 1)
+	cached := server.request("GET", video+"?apply=clip&end=1.2&start=0.4", "")
+	c.Assert(cached.status, Equals, http.StatusOK)
+	c.Check(cached.body.Bytes(), DeepEquals, mock.body.Bytes())
+	c.Check(cached.header.Get("X-Istore-Clip-Start"), Equals, "0.400000")
+
+	mock = server.request("GET", video+"?apply=clip&start=1&end=0.5", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+	mock = server.request("GET", video+"?apply=clip&format=gif", "")
+	c.Check(mock.status, Equals, http.StatusBadRequest)
+}
+
+func (_ *S) TestTranscode(c *C) {
+	server := newTestServer()
+	defer func(dir string) { TranscodeCacheDir = dir }(TranscodeCacheDir)
+	// streamed from the temporary file without the cache
+	TranscodeCacheDir = ""
+	video := "/path/video/file://" + testdataFile("sample.avi")
+	server.request("POST", video, "")
+
+	mock := server.request("GET", video+"?apply=transcode&w=32&format=matroska", "")
+	c.Assert(mock.status, Equals, http.StatusOK)
+	c.Check(mock.header.Get("Content-Type"), Equals, "video/x-matroska")
+	c.Check(mock.header.Get("Content-Length"), Equals, strconv.Itoa(mock.body.Len()))
+	info, err := probe(bytes.NewReader(mock.body.Bytes()))
+	c.Assert(err, IsNil)
+	c.Check(info["width"], Equals, int64(32))
+	c.Check(info["height"], Equals, int64(24))
+}
+
+func (_ *S) TestParseTranscodeOptions(c *C) {
+	parse := func(query string) (*transcodeOptions, error) {
+		r, _ := http.NewRequest("GET", "http://example.com/a?"+query, nil)
+		return parseTranscodeOptions(r, "transcode")
+	}
+
+	opts, err := parse("start=1.5&end=3&w=320&bitrate=500000&format=webm&audio=none")
+	c.Assert(err, IsNil)
+	c.Check(*opts, Equals, transcodeOptions{
+		Start: 1.5, End: 3, Container: "webm", Transcode: true,
+		Width: 320, BitRate: 500000, NoAudio: true,
+	})
+
+	for _, query := range []string{
+		"start=abc", "end=x", "start=-1", "start=2&end=1", "start=NaN", "end=Inf&start=Inf",
+		"w=-1", "h=100000", "bitrate=fast", "bitrate=-1", "format=gif",
+	} {
+		_, err := parse(query)
+		c.Check(errorStatus(err, nil), Equals, http.StatusBadRequest, Commentf(query))
+	}
+}
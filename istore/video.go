@@ -0,0 +1,251 @@
+package istore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/golang/glog"
+	"github.com/umitanuki/gmf"
+)
+
+// videoDecoder decodes frames of the best video stream in the input, and
+// converts them to RGB images.
+type videoDecoder struct {
+	ctx      *gmf.FmtCtx
+	ioctx    *gmf.AVIOContext
+	stream   *gmf.Stream
+	cc       *gmf.CodecCtx
+	swsCtx   *gmf.SwsCtx
+	dstFrame *gmf.Frame
+}
+
+// openInput opens the demuxer for the input.  The caller releases ioctx
+// and ctx (in this order) when done.
+func openInput(input io.Reader) (*gmf.FmtCtx, *gmf.AVIOContext, error) {
+	ctx := gmf.NewCtx()
+	ioctx, err := gmf.NewAVIOContext(ctx, makeInputHandlers(input))
+	if err != nil {
+		ctx.CloseInputAndRelease()
+		return nil, nil, err
+	}
+	ctx.SetPb(ioctx)
+
+	if err := ctx.OpenInput("dummy"); err != nil {
+		glog.Error(err)
+		gmf.Release(ioctx)
+		ctx.CloseInputAndRelease()
+		return nil, nil, err
+	}
+	return ctx, ioctx, nil
+}
+
+func newVideoDecoder(input io.Reader) (*videoDecoder, error) {
+	ctx, ioctx, err := openInput(input)
+	if err != nil {
+		return nil, err
+	}
+	d := &videoDecoder{ctx: ctx, ioctx: ioctx}
+
+	if d.stream, err = d.ctx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO); err != nil {
+		glog.Error(err)
+		d.Close()
+		return nil, err
+	}
+
+	// The encoder is not used, but sws needs the destination context.
+	codec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_JPEG2000)
+	if err != nil {
+		glog.Error(err)
+		d.Close()
+		return nil, err
+	}
+
+	d.cc = gmf.NewCodecCtx(codec)
+	d.cc.SetPixFmt(gmf.AV_PIX_FMT_RGB24).
+		SetWidth(d.stream.CodecCtx().Width()).
+		SetHeight(d.stream.CodecCtx().Height())
+
+	if codec.IsExperimental() {
+		d.cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
+	}
+
+	if err = d.cc.Open(nil); err != nil {
+		glog.Error(err)
+		d.Close()
+		return nil, err
+	}
+
+	// Just to surprress "deprected format" warning...
+	d.cc.SetPixFmt(gmf.AV_PIX_FMT_RGB24)
+
+	d.swsCtx = gmf.NewSwsCtx(d.stream.CodecCtx(), d.cc, gmf.SWS_POINT)
+
+	d.dstFrame = gmf.NewFrame().
+		SetWidth(d.stream.CodecCtx().Width()).
+		SetHeight(d.stream.CodecCtx().Height()).
+		SetFormat(gmf.AV_PIX_FMT_RGB24)
+
+	if err := d.dstFrame.ImgAlloc(); err != nil {
+		glog.Error(err)
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *videoDecoder) Close() {
+	if d.dstFrame != nil {
+		gmf.Release(d.dstFrame)
+	}
+	if d.swsCtx != nil {
+		gmf.Release(d.swsCtx)
+	}
+	if d.stream != nil {
+		// This is necessary to avoid leaking thread used by codec.
+		d.stream.CodecCtx().Close()
+	}
+	if d.cc != nil {
+		d.cc.Close()
+		gmf.Release(d.cc)
+	}
+	if d.ioctx != nil {
+		gmf.Release(d.ioctx)
+	}
+	d.ctx.CloseInputAndRelease()
+}
+
+// Duration returns the duration of the input in seconds.
+func (d *videoDecoder) Duration() float64 {
+	return float64(d.ctx.Duration()) / float64(gmf.AV_TIME_BASE)
+}
+
+// FrameDuration estimates the duration of a frame in seconds from the
+// number of frames in the stream.  It returns 0 if unknown.
+func (d *videoDecoder) FrameDuration() float64 {
+	return frameDuration(d.stream)
+}
+
+func frameDuration(stream *gmf.Stream) float64 {
+	nbFrames := stream.NbFrames()
+	if nbFrames <= 0 || stream.Duration() <= 0 {
+		return 0
+	}
+	tb := stream.TimeBase().AVR()
+	return float64(stream.Duration()) * float64(tb.Num) / float64(tb.Den) / float64(nbFrames)
+}
+
+// toTs converts seconds from the beginning to the stream timestamp.
+func (d *videoDecoder) toTs(sec float64) int {
+	return streamTs(d.ctx, d.stream, sec)
+}
+
+// Seconds converts the stream timestamp to seconds from the beginning.
+func (d *videoDecoder) Seconds(ts int) float64 {
+	return streamSeconds(d.ctx, d.stream, ts)
+}
+
+// Seek moves to the keyframe at or before sec.  Decoding continues from
+// the current position if the input is not seekable.
+func (d *videoDecoder) Seek(sec float64) {
+	if seekStream(d.ctx, d.stream, sec) {
+		d.stream.CodecCtx().FlushBuffers()
+	}
+}
+
+func streamTs(ctx *gmf.FmtCtx, stream *gmf.Stream, sec float64) int {
+	usec := int(sec * float64(gmf.AV_TIME_BASE))
+	if start := ctx.StartTime(); start > 0 {
+		usec += start
+	}
+	return gmf.RescaleQ(usec, gmf.AV_TIME_BASE_Q, stream.TimeBase())
+}
+
+func streamSeconds(ctx *gmf.FmtCtx, stream *gmf.Stream, ts int) float64 {
+	usec := gmf.RescaleQ(ts, stream.TimeBase(), gmf.AV_TIME_BASE_Q)
+	if start := ctx.StartTime(); start > 0 {
+		usec -= start
+	}
+	return float64(usec) / float64(gmf.AV_TIME_BASE)
+}
+
+// seekStream returns false if it failed to seek.
+func seekStream(ctx *gmf.FmtCtx, stream *gmf.Stream, sec float64) bool {
+	ts := streamTs(ctx, stream, sec)
+	if err := ctx.SeekFile(stream, ts, ts, 0); err != nil {
+		glog.Error(err, fmt.Sprintf(" (seek to %v)", sec))
+		return false
+	}
+	return true
+}
+
+// Decode calls fn for each frame of the video stream until fn returns true.
+// It returns io.EOF if the stream ends before that.
+func (d *videoDecoder) Decode(fn func(frame *gmf.Frame) (bool, error)) error {
+	for {
+		packet := d.ctx.GetNextPacket()
+		if packet == nil {
+			return io.EOF
+		}
+
+		// Wrap by anonymous func so we can use defer for each iteration.
+		done, err := func(packet *gmf.Packet) (bool, error) {
+			defer gmf.Release(packet)
+
+			if packet.StreamIndex() != d.stream.Index() {
+				return false, nil
+			}
+
+			for {
+				frame, err := packet.GetNextFrame(d.stream.CodecCtx())
+				if frame == nil || err != nil {
+					return false, err
+				}
+
+				done, err := fn(frame)
+				gmf.Release(frame)
+				if done || err != nil {
+					return done, err
+				}
+			}
+		}(packet)
+
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// Image converts the decoded frame to RGBA image.
+func (d *videoDecoder) Image(frame *gmf.Frame) *image.RGBA {
+	d.swsCtx.Scale(frame, d.dstFrame)
+
+	// TODO: we could avoid even copy with the loop
+	// by introducing RGB type implementing image.Image
+	streamIndex := 0 // not sure how to determine this??
+	src := d.dstFrame.Data(streamIndex)
+	img := image.NewRGBA(image.Rect(0, 0, d.dstFrame.Width(), d.dstFrame.Height()))
+	stride := img.Stride
+	linesize := d.dstFrame.LineSize(streamIndex)
+	for y := 0; y < d.dstFrame.Height(); y++ {
+		for x := 0; x < d.dstFrame.Width(); x++ {
+			img.Pix[y*stride+x*4+0] = src[y*linesize+x*3+0]
+			img.Pix[y*stride+x*4+1] = src[y*linesize+x*3+1]
+			img.Pix[y*stride+x*4+2] = src[y*linesize+x*3+2]
+			img.Pix[y*stride+x*4+3] = 255
+		}
+	}
+	return img
+}
+
+func encodeJPEG(img image.Image) []byte {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+	return buf.Bytes()
+}
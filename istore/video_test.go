@@ -0,0 +1,58 @@
+package istore
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+// testdata/sample.avi is 64x48 MJPEG of 10 frames at 5 fps.  Every frame is
+// keyframe, and the gray level of frame i is 20+20*i.
+func sampleFrameIndex(c *C, data []byte) int {
+	m, _, err := image.Decode(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(m.Bounds(), Equals, image.Rect(0, 0, 64, 48))
+	gray := color.GrayModel.Convert(m.At(32, 24)).(color.Gray)
+	return (int(gray.Y) - 10) / 20
+}
+
+func (_ *S) TestFrame(c *C) {
+	server := newTestServer()
+	video := "/path/video/file://" + testdataFile("sample.avi")
+	server.request("POST", video, "")
+
+	frame := func(query string) (int, string) {
+		mock := server.request("GET", video+"?apply=frame&"+query, "")
+		c.Assert(mock.status, Equals, http.StatusOK)
+		c.Check(mock.header.Get("Content-Type"), Equals, "image/jpeg")
+		return sampleFrameIndex(c, mock.body.Bytes()), mock.header.Get("X-Istore-Frame-Timestamp")
+	}
+
+	index, ts := frame("n=0")
+	c.Check(index, Equals, 0)
+	c.Check(ts, Equals, "0.000000")
+	index, ts = frame("n=3")
+	c.Check(index, Equals, 3)
+	c.Check(ts, Equals, "0.600000")
+
+	// the nearest frame of 650ms is at 600ms
+	index, ts = frame("ms=650")
+	c.Check(index, Equals, 3)
+	c.Check(ts, Equals, "0.600000")
+	index, ts = frame("sec=1.25")
+	c.Check(index, Equals, 6)
+	c.Check(ts, Equals, "1.200000")
+
+	// the keyframe at or before the time, even if the next one is nearer
+	index, ts = frame("ms=1550&keyframe=nearest")
+	c.Check(index, Equals, 7)
+	c.Check(ts, Equals, "1.400000")
+
+	mock := server.request("GET", video+"?apply=frame&n=-1", "")
+	c.Check(mock.status, Not(Equals), http.StatusOK)
+	mock = server.request("GET", video+"?apply=frame&ms=60000", "")
+	c.Check(mock.status, Not(Equals), http.StatusOK)
+}
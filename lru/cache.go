@@ -66,8 +66,9 @@ func (c *Cache) Set(key string, value []byte) {
 }
 
 func (c *Cache) Get(key string) (value []byte, ok bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	// MoveToFront modifies the list.
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	if ele, hit := c.cache[key]; hit {
 		c.ll.MoveToFront(ele)